@@ -0,0 +1,56 @@
+package sproket
+
+import (
+	"strings"
+)
+
+// Services a data node can offer access to a file through, as named in the url field of a document
+const (
+	ServiceHTTP    = "HTTPServer"
+	ServiceGridFTP = "GridFTP"
+	ServiceGlobus  = "Globus"
+	ServiceOPeNDAP = "OPENDAP"
+)
+
+// AccessURL is one way of accessing a file, decoded from an entry of the url field like URL|mime type|service
+type AccessURL struct {
+	URL      string
+	MimeType string
+	Service  string
+}
+
+// Access returns every way of accessing the file, in the order the index lists them. A document built with only
+// an HTTPURL is accessed through it
+func (d *Doc) Access() []AccessURL {
+	if len(d.URLs) == 0 && d.HTTPURL != "" {
+		return []AccessURL{{URL: d.HTTPURL, Service: ServiceHTTP}}
+	}
+	var access []AccessURL
+	for _, entry := range d.URLs {
+		parts := strings.Split(entry, "|")
+		a := AccessURL{URL: parts[0]}
+		if len(parts) > 1 {
+			a.MimeType = parts[1]
+		}
+		if len(parts) > 2 {
+			a.Service = parts[2]
+		}
+		access = append(access, a)
+	}
+	return access
+}
+
+// AccessFor returns the ways of accessing the file through the services, in the order of the services given.
+// Service names are matched regardless of case
+func (d *Doc) AccessFor(services []string) []AccessURL {
+	access := d.Access()
+	var result []AccessURL
+	for _, service := range services {
+		for _, a := range access {
+			if strings.EqualFold(a.Service, service) {
+				result = append(result, a)
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,134 @@
+package sproket
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Names of the search backends, set as search_backend in the config or detected when empty
+const (
+	BackendSolr = "solr"
+	BackendSTAC = "stac"
+)
+
+// Backend performs a search against a single search API. Searches are described by the parameters of the
+// classic ESGF search API and answered in its Solr response format, so every backend is used the same way
+type Backend interface {
+	Search(ctx context.Context, s *Search, endpoint string, params map[string]string) ([]byte, error)
+}
+
+// SolrBackend searches the classic Solr backed ESGF search API
+type SolrBackend struct{}
+
+// Search performs the search, attempting it again per the retry policy until ctx is done
+func (SolrBackend) Search(ctx context.Context, s *Search, endpoint string, params map[string]string) ([]byte, error) {
+
+	// Build the search path
+	values := url.Values{}
+	for key, value := range params {
+		values.Add(key, value)
+	}
+	query := values.Encode()
+	path := fmt.Sprintf("%s?%s", endpoint, query)
+
+	// Perform query
+	buff := bytes.Buffer{}
+	err := s.client().retry(ctx, path, func() error {
+		buff.Reset()
+		return s.client().GetContext(ctx, path, &buff)
+	})
+	return buff.Bytes(), err
+}
+
+// backend returns the backend for the endpoint, as configured or else detected from what the endpoint serves
+func (s *Search) backend(ctx context.Context, endpoint string) Backend {
+	if s.Backend != nil {
+		return s.Backend
+	}
+	name := strings.ToLower(s.SearchBackend)
+	if name == "" {
+		name = s.client().detectBackend(ctx, endpoint)
+	}
+	if name == BackendSTAC {
+		return STACBackend{}
+	}
+	return SolrBackend{}
+}
+
+// detectBackend works out which backend an endpoint speaks, a STAC API serves a landing page naming its
+// stac_version. The answer is remembered so each endpoint is only checked once
+func (c *Client) detectBackend(ctx context.Context, endpoint string) string {
+	c.mutex.Lock()
+	name, in := c.backends[endpoint]
+	c.mutex.Unlock()
+	if in {
+		return name
+	}
+
+	name = BackendSolr
+	if !(strings.Contains(endpoint, "esg-search")) {
+		var landing struct {
+			STACVersion string `json:"stac_version"`
+		}
+		buff := bytes.Buffer{}
+		found := c.Limit.wait(ctx, hostOf(endpoint)) == nil && c.GetContext(ctx, stacRoot(endpoint), &buff) == nil
+		if found && json.Unmarshal(buff.Bytes(), &landing) == nil && landing.STACVersion != "" {
+			name = BackendSTAC
+		}
+	}
+	// A failure to reach the endpoint is not an answer, the search itself reports the failure
+	if ctx.Err() == nil {
+		c.mutex.Lock()
+		if c.backends == nil {
+			c.backends = make(map[string]string)
+		}
+		c.backends[endpoint] = name
+		c.mutex.Unlock()
+	}
+	return name
+}
+
+// retry calls attempt, a request to target, until it succeeds, the retry policy's attempts are used up or ctx
+// is done. Each attempt waits its turn under the rate limit. A host that is overloaded holds back every request
+// to it for as long as its Retry-After asks, or else the backoff
+func (c *Client) retry(ctx context.Context, target string, attempt func() error) error {
+	host := hostOf(target)
+	backoff := c.Retry.Backoff
+	var err error
+	for i := 0; i == 0 || (err != nil && i < c.Retry.Attempts); i++ {
+		if i > 0 {
+			var status *StatusError
+			// The rate limit already holds back requests to an overloaded host
+			if !(errors.As(err, &status) && status.busy()) {
+				select {
+				case <-ctx.Done():
+					return err
+				case <-time.After(backoff):
+				}
+			}
+			backoff *= 2
+		}
+		if waitErr := c.Limit.wait(ctx, host); waitErr != nil {
+			if err == nil {
+				err = waitErr
+			}
+			return err
+		}
+		err = attempt()
+		var status *StatusError
+		if errors.As(err, &status) && status.busy() {
+			delay := status.RetryAfter
+			if delay == 0 {
+				delay = backoff
+			}
+			c.Limit.backOff(host, delay)
+		}
+	}
+	return err
+}
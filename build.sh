@@ -15,6 +15,6 @@
 # solaris/amd64
 # windows/amd64
 
-GOOS=darwin go build -o build/sproket-darwin cmd/sproket/main.go
-GOOS=linux go build -o build/sproket-linux cmd/sproket/main.go
-GOOS=windows go build -o build/sproket-windows cmd/sproket/main.go
+GOOS=darwin go build -o build/sproket-darwin ./cmd/sproket
+GOOS=linux go build -o build/sproket-linux ./cmd/sproket
+GOOS=windows go build -o build/sproket-windows ./cmd/sproket
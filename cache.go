@@ -0,0 +1,101 @@
+package sproket
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Cache keeps the responses of count and facet searches, those with a limit of 0, so repeating one within a
+// run costs nothing. With a directory, responses are also kept on disk for TTL so later runs reuse them too.
+// Within a run it also keeps where the pages of STAC searches start
+type Cache struct {
+	Dir     string
+	TTL     time.Duration
+	mutex   sync.Mutex
+	entries map[string][]byte
+	walks   map[string]*stacWalk
+}
+
+// NewCache returns a cache kept in memory, and in dir for ttl if dir is not empty
+func NewCache(dir string, ttl time.Duration) *Cache {
+	return &Cache{Dir: dir, TTL: ttl, entries: make(map[string][]byte)}
+}
+
+// cacheKey serializes a search against an endpoint, the parameters are encoded in sorted order
+func cacheKey(endpoint string, params map[string]string) string {
+	values := url.Values{}
+	for key, value := range params {
+		values.Add(key, value)
+	}
+	return fmt.Sprintf("%s?%s", endpoint, values.Encode())
+}
+
+// cacheable reports whether the response to a search is kept, only counts and facets are small enough
+func cacheable(params map[string]string) bool {
+	return params["limit"] == "0"
+}
+
+// path returns the file an entry is kept in on disk
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.Dir, fmt.Sprintf("%x.json", sha256.Sum256([]byte(key))))
+}
+
+// get returns the response kept for key, if there is one and it has not expired
+func (c *Cache) get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mutex.Lock()
+	body, in := c.entries[key]
+	c.mutex.Unlock()
+	if in || c.Dir == "" {
+		return body, in
+	}
+	info, err := os.Stat(c.path(key))
+	if err != nil || time.Since(info.ModTime()) > c.TTL {
+		return nil, false
+	}
+	body, err = ioutil.ReadFile(c.path(key))
+	if err != nil {
+		return nil, false
+	}
+	c.mutex.Lock()
+	c.entries[key] = body
+	c.mutex.Unlock()
+	return body, true
+}
+
+// put keeps the response for key
+func (c *Cache) put(key string, body []byte) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	c.entries[key] = body
+	c.mutex.Unlock()
+	if c.Dir == "" {
+		return
+	}
+	// Written in full before it replaces an older entry, so a concurrent run never reads half an entry
+	tmp := fmt.Sprintf("%s.%d.tmp", c.path(key), os.Getpid())
+	if err := ioutil.WriteFile(tmp, body, 0644); err == nil {
+		os.Rename(tmp, c.path(key))
+	}
+}
+
+// Clear forgets the responses kept in memory, so the next searches ask the search API again or read the disk
+func (c *Cache) Clear() {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = make(map[string][]byte)
+	c.walks = nil
+}
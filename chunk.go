@@ -0,0 +1,241 @@
+package sproket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// MaxSegments caps the number of concurrent connections used to download a single file
+const MaxSegments = 8
+
+// chunkSize is the size of the ranges a segmented download is split into, and resumed by
+const chunkSize = 32 * 1024 * 1024
+
+// chunkState records which chunks of a segmented download are complete, it is kept next to the download
+type chunkState struct {
+	Size      int64  `json:"size"`
+	ChunkSize int64  `json:"chunk_size"`
+	Done      []bool `json:"done"`
+	path      string
+	mutex     sync.Mutex
+}
+
+// ChunkStatePath returns the path of the resume state kept for a segmented download to dest
+func ChunkStatePath(dest string) string {
+	return fmt.Sprintf("%s.chunks", dest)
+}
+
+// RemoveChunked removes a segmented download and its resume state, so the next attempt starts over
+func RemoveChunked(dest string) error {
+	os.Remove(ChunkStatePath(dest))
+	err := os.Remove(dest)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// loadChunkState returns the resume state for a segmented download of size bytes to dest, and whether
+// it is resumable, which requires state for a download of the same size and a partial file to go with it
+func loadChunkState(dest string, size int64) (*chunkState, bool) {
+	state := chunkState{path: ChunkStatePath(dest)}
+	fileBytes, err := ioutil.ReadFile(state.path)
+	if err == nil && json.Unmarshal(fileBytes, &state) == nil && state.Size == size && state.ChunkSize > 0 &&
+		int64(len(state.Done)) == (size+state.ChunkSize-1)/state.ChunkSize {
+		if info, err := os.Stat(dest); err == nil && info.Size() == size {
+			return &state, true
+		}
+	}
+	state.Size = size
+	state.ChunkSize = chunkSize
+	state.Done = make([]bool, (size+chunkSize-1)/chunkSize)
+	return &state, false
+}
+
+// complete marks a chunk as done once the data written for it is on disk
+func (c *chunkState) complete(f *os.File, chunk int) error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	c.Done[chunk] = true
+	c.mutex.Unlock()
+	return c.save()
+}
+
+// save writes the state, replacing the previous copy only once it is completely written
+func (c *chunkState) save() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	fileBytes, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.tmp", c.path)
+	if err := ioutil.WriteFile(tmp, fileBytes, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// GetChunked downloads inURL to the file at dest using up to segments concurrent ranged requests,
+// falling back to a single stream when the server does not support ranges or the file is small.
+// Completed chunks are recorded next to dest so an interrupted download only fetches the missing ranges
+func (c *Client) GetChunked(inURL string, dest string, segments int) error {
+	return c.GetChunkedContext(context.Background(), inURL, dest, segments)
+}
+
+// GetChunkedContext is GetChunked, abandoning the download once ctx is done. Chunks completed by then
+// stay recorded, so calling it again resumes the download
+func (c *Client) GetChunkedContext(ctx context.Context, inURL string, dest string, segments int) error {
+	if segments > MaxSegments {
+		segments = MaxSegments
+	}
+	size, ranged, err := c.rangeSupport(ctx, inURL)
+	if err != nil {
+		return err
+	}
+	if !(ranged) || segments < 2 || size < 2*chunkSize {
+		os.Remove(ChunkStatePath(dest))
+		f, err := os.Create(dest)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return c.GetContext(ctx, inURL, f)
+	}
+
+	// Chunks write into their own region of a file preallocated to the full size
+	state, resumed := loadChunkState(dest, size)
+	flags := os.O_RDWR | os.O_CREATE
+	if !(resumed) {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(dest, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if !(resumed) {
+		if err := f.Truncate(size); err != nil {
+			return err
+		}
+		if err := state.save(); err != nil {
+			return err
+		}
+	}
+	var pending []int
+	for chunk, done := range state.Done {
+		if !(done) {
+			pending = append(pending, chunk)
+		}
+	}
+
+	// Each connection takes the next missing chunk until none remain or one fails
+	chunks := make(chan int)
+	failed := make(chan struct{})
+	var firstErr error
+	var errMutex sync.Mutex
+	fail := func(err error) {
+		errMutex.Lock()
+		defer errMutex.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			close(failed)
+		}
+	}
+	waiter := sync.WaitGroup{}
+	for i := 0; i < segments; i++ {
+		waiter.Add(1)
+		go func() {
+			defer waiter.Done()
+			for chunk := range chunks {
+				start := int64(chunk) * state.ChunkSize
+				end := start + state.ChunkSize - 1
+				if end >= size {
+					end = size - 1
+				}
+				if err := c.getRange(ctx, inURL, f, start, end); err != nil {
+					fail(err)
+					return
+				}
+				if err := state.complete(f, chunk); err != nil {
+					fail(err)
+					return
+				}
+			}
+		}()
+	}
+feed:
+	for _, chunk := range pending {
+		select {
+		case chunks <- chunk:
+		case <-failed:
+			break feed
+		}
+	}
+	close(chunks)
+	waiter.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return os.Remove(state.path)
+}
+
+// rangeSupport reports the size of the file at inURL and whether the server accepts byte ranges for it
+func (c *Client) rangeSupport(ctx context.Context, inURL string) (int64, bool, error) {
+	req, err := c.newRequest(ctx, "HEAD", inURL)
+	if err != nil {
+		return 0, false, err
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	resp.Body.Close()
+
+	// Some servers refuse HEAD requests, the regular download reports any real problem
+	if resp.StatusCode != http.StatusOK {
+		return 0, false, nil
+	}
+	ranged := strings.Contains(resp.Header.Get("Accept-Ranges"), "bytes")
+	return resp.ContentLength, ranged && resp.ContentLength > 0, nil
+}
+
+// getRange downloads the inclusive byte range start-end of inURL into the same region of f
+func (c *Client) getRange(ctx context.Context, inURL string, f *os.File, start int64, end int64) error {
+	req, err := c.newRequest(ctx, "GET", inURL)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("range %d-%d: %s", start, end, resp.Status)
+	}
+
+	nBytes, err := io.Copy(io.NewOffsetWriter(f, start), resp.Body)
+	if err != nil {
+		return err
+	}
+	if nBytes != end-start+1 {
+		return fmt.Errorf("range %d-%d size mismatch: %d != %d", start, end, nBytes, end-start+1)
+	}
+	return nil
+}
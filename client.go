@@ -0,0 +1,73 @@
+package sproket
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Client holds the network settings used to reach search APIs and data nodes, each Client is independent
+// of any other so differently configured clients may be used side by side
+type Client struct {
+	HTTPClient *http.Client
+	Agent      string
+	Retry      RetryPolicy
+	Cache      *Cache
+	Limit      *RateLimit
+	mutex      sync.Mutex
+	noCursor   map[string]bool
+	backends   map[string]string
+}
+
+// RetryPolicy controls how failed search API requests are attempted again
+type RetryPolicy struct {
+	Attempts int
+	Backoff  time.Duration
+}
+
+// NewClient returns a client making requests with httpClient, identifying itself as agent
+func NewClient(httpClient *http.Client, agent string, retry RetryPolicy) *Client {
+	return &Client{
+		HTTPClient: httpClient,
+		Agent:      agent,
+		Retry:      retry,
+		Cache:      NewCache("", 0),
+		Limit:      NewRateLimit(0),
+		noCursor:   make(map[string]bool),
+	}
+}
+
+// defaultClient is shared by searches without a client of their own, it is created on first use
+var (
+	defaultClient     *Client
+	defaultClientOnce sync.Once
+)
+
+// client returns the client of the search, or the default client if none is set. The search is left
+// untouched, so concurrent searches of it do not race
+func (s *Search) client() *Client {
+	if s.Client != nil {
+		return s.Client
+	}
+	defaultClientOnce.Do(func() {
+		defaultClient = NewClient(&http.Client{}, "sproket", RetryPolicy{Attempts: 1})
+	})
+	return defaultClient
+}
+
+// cursorSupported reports whether the search API has not been found to reject cursors
+func (c *Client) cursorSupported(api string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return !(c.noCursor[api])
+}
+
+// noCursorSupport records that the search API does not support cursors, so it is only tried once
+func (c *Client) noCursorSupport(api string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.noCursor == nil {
+		c.noCursor = make(map[string]bool)
+	}
+	c.noCursor[api] = true
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sproket"
+	"strings"
+	"time"
+)
+
+// Statuses of a local file found by an audit
+const (
+	auditCurrent    = "current"
+	auditRetracted  = "retracted"
+	auditSuperseded = "superseded"
+	auditMissing    = "missing"
+)
+
+// auditBatch is the number of files looked up in the index at once
+const auditBatch = 50
+
+// auditEntry is the audit result of a single local file
+type auditEntry struct {
+	InstanceID    string `json:"instance_id"`
+	Path          string `json:"path"`
+	Status        string `json:"status"`
+	DatasetID     string `json:"dataset_id,omitempty"`
+	Version       string `json:"version,omitempty"`
+	LatestVersion string `json:"latest_version,omitempty"`
+}
+
+// auditReport is the machine readable report written by -audit.out
+type auditReport struct {
+	SearchAPI string         `json:"search_api"`
+	Time      time.Time      `json:"time"`
+	Summary   map[string]int `json:"summary"`
+	Files     []auditEntry   `json:"files"`
+}
+
+// audit checks every local file against the index, reporting those retracted, superseded or gone from the index
+func audit(args *config) {
+	entries := localHoldings(args)
+	if len(entries) == 0 {
+		fmt.Printf("no files found to audit in %s\n", args.outDir)
+		return
+	}
+
+	// Only the instance_id matters, not the search criteria
+	search := args.search
+	search.Fields = make(map[string]string)
+	search.Query = ""
+	search.Start, search.End, search.BBox = "", "", nil
+	search.FileFacets = []string{"latest", "retracted"}
+
+	byID := make(map[string]*auditEntry)
+	var ids []string
+	for i := range entries {
+		entries[i].Status = auditMissing
+		byID[entries[i].InstanceID] = &entries[i]
+		ids = append(ids, entries[i].InstanceID)
+	}
+	for first := 0; first < len(ids); first += auditBatch {
+		last := first + auditBatch
+		if last > len(ids) {
+			last = len(ids)
+		}
+		search.Fields["instance_id"] = sproket.TermMatch(ids[first:last])
+		pages := search.Pages(250)
+		for pages.Next() {
+			for _, doc := range pages.Docs() {
+				entry, in := byID[doc.InstanceID]
+				if !(in) {
+					continue
+				}
+				entry.DatasetID = doc.GetDatasetInstanceID()
+				entry.Version = doc.GetDatasetVersion()
+				// Any copy retracted means the file is retracted, the original and replicas are retracted together
+				switch {
+				case doc.Facets["retracted"] == "true":
+					entry.Status = auditRetracted
+				case entry.Status == auditRetracted:
+				case doc.Facets["latest"] == "false":
+					entry.Status = auditSuperseded
+				case entry.Status == auditMissing:
+					entry.Status = auditCurrent
+				}
+			}
+		}
+	}
+	findLatestVersions(args, entries)
+
+	report := auditReport{
+		SearchAPI: args.search.API.String(),
+		Time:      time.Now().UTC(),
+		Summary:   make(map[string]int),
+		Files:     entries,
+	}
+	for _, entry := range entries {
+		report.Summary[entry.Status]++
+	}
+
+	if args.auditOut != "" {
+		fileBytes, err := json.MarshalIndent(report, "", "    ")
+		if err == nil {
+			err = ioutil.WriteFile(args.auditOut, fileBytes, 0644)
+		}
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	} else {
+		for _, entry := range entries {
+			if entry.Status == auditCurrent {
+				continue
+			}
+			fmt.Printf("%s\t%s", entry.Status, entry.Path)
+			if entry.LatestVersion != "" {
+				fmt.Printf("\t%s is the latest version", entry.LatestVersion)
+			}
+			fmt.Println()
+		}
+	}
+	fmt.Printf("%d files audited: %d current, %d retracted, %d superseded, %d missing from the index\n", len(entries),
+		report.Summary[auditCurrent], report.Summary[auditRetracted], report.Summary[auditSuperseded], report.Summary[auditMissing])
+}
+
+// findLatestVersions finds the latest version of the datasets of superseded files
+func findLatestVersions(args *config, entries []auditEntry) {
+	masters := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.Status == auditSuperseded && entry.Version != "" {
+			masters[strings.TrimSuffix(entry.DatasetID, "."+entry.Version)] = true
+		}
+	}
+	if len(masters) == 0 {
+		return
+	}
+	var masterIDs []string
+	for masterID := range masters {
+		masterIDs = append(masterIDs, masterID)
+	}
+	sort.Strings(masterIDs)
+
+	search := args.search
+	search.Query = ""
+	search.Start, search.End, search.BBox = "", "", nil
+	latest := make(map[string]string)
+	for first := 0; first < len(masterIDs); first += auditBatch {
+		last := first + auditBatch
+		if last > len(masterIDs) {
+			last = len(masterIDs)
+		}
+		search.Fields = map[string]string{
+			"master_id": sproket.TermMatch(masterIDs[first:last]),
+			"latest":    "true",
+			"replica":   "false",
+		}
+		for cur := 0; ; cur += 250 {
+			page, remaining := search.SearchDatasets(cur, 250)
+			for _, dataset := range page {
+				version := dataset.InstanceID[strings.LastIndex(dataset.InstanceID, ".")+1:]
+				latest[strings.TrimSuffix(dataset.InstanceID, "."+version)] = version
+			}
+			if remaining == 0 || len(page) == 0 {
+				break
+			}
+		}
+	}
+	for i, entry := range entries {
+		if entry.Status == auditSuperseded {
+			entries[i].LatestVersion = latest[strings.TrimSuffix(entry.DatasetID, "."+entry.Version)]
+		}
+	}
+}
+
+// localHoldings lists the local files to audit, from the manifest if there is one or else the output directory
+func localHoldings(args *config) []auditEntry {
+	var entries []auditEntry
+	m := args.manifest
+	if m == nil {
+		var err error
+		m, err = loadManifest(filepath.Join(args.outDir, "sproket_manifest.json"), args.outDir)
+		if err != nil {
+			fmt.Println(err)
+			return nil
+		}
+	}
+	for _, entry := range m.Files {
+		entries = append(entries, auditEntry{
+			InstanceID: entry.InstanceID,
+			Path:       filepath.Join(args.outDir, filepath.FromSlash(entry.Path)),
+		})
+	}
+
+	// Without a manifest, files are named by their encoded instance_id, or recorded in the names file if hashed
+	if len(entries) == 0 {
+		hashed := instanceNames(args.outDir)
+		filepath.Walk(args.outDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			name := info.Name()
+			if strings.HasSuffix(name, ".part") || strings.HasSuffix(name, ".held") || strings.HasSuffix(name, ".chunks") || strings.HasSuffix(name, ".tmp") ||
+				strings.HasSuffix(name, "sums.txt") || strings.HasSuffix(name, ".json") {
+				return nil
+			}
+			instanceID, ok := hashed[name]
+			if !(ok) {
+				instanceID = instanceOf(name)
+			}
+			entries = append(entries, auditEntry{InstanceID: instanceID, Path: path})
+			return nil
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].InstanceID < entries[j].InstanceID
+	})
+	return entries
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+)
+
+// budget stops queuing files once their total size would exceed -max.bytes
+type budget struct {
+	limit        int64
+	queuePath    string
+	queued       int64
+	full         bool
+	deferred     []*task
+	deferredSize int64
+}
+
+// newBudget returns the budget for a limit like 500GB, or nil if there is no limit
+func newBudget(maxBytes string, queuePath string) (*budget, error) {
+	limit, err := parseSize(maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	if limit == 0 {
+		if queuePath != "" {
+			return nil, fmt.Errorf("-max.queue requires -max.bytes")
+		}
+		return nil, nil
+	}
+	return &budget{limit: limit, queuePath: queuePath}, nil
+}
+
+// allow reports whether the task fits in what is left of the budget. Once a file does not fit, no later file
+// is queued either, so the files downloaded are a prefix of the -order
+func (b *budget) allow(t *task) bool {
+	if b == nil {
+		return true
+	}
+	size := t.Docs[0].Size
+	if !(b.full) && b.queued+size <= b.limit {
+		b.queued += size
+		return true
+	}
+	b.full = true
+	b.deferred = append(b.deferred, t)
+	b.deferredSize += size
+	return false
+}
+
+// report lists the files left out by the budget, adding them to the -max.queue job file if desired
+func (b *budget) report(args *config) {
+	if b == nil || len(b.deferred) == 0 {
+		return
+	}
+	verb := "deferred"
+	if b.queuePath != "" {
+		queue, err := loadJob(b.queuePath)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		for _, t := range b.deferred {
+			queue.add(t)
+		}
+		if err := queue.save(); err != nil {
+			fmt.Println(err)
+			return
+		}
+		verb = fmt.Sprintf("deferred to the job %s", b.queuePath)
+	} else if args.job != nil {
+		verb = "deferred, they remain pending in the job"
+	}
+	fmt.Printf("%d files (%s in total) %s, the -max.bytes budget of %s was reached with %s queued\n",
+		len(b.deferred), formatSize(b.deferredSize), verb, formatSize(b.limit), formatSize(b.queued))
+	if args.verbose {
+		for _, t := range b.deferred {
+			fmt.Printf("%s\t%s\n", t.InstanceID, formatSize(t.Docs[0].Size))
+		}
+	}
+}
+
+// reset starts a new budget, for the next search of -watch
+func (b *budget) reset() {
+	if b == nil {
+		return
+	}
+	b.queued, b.full = 0, false
+	b.deferred, b.deferredSize = nil, 0
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sproket"
+	"strings"
+	"sync"
+	"time"
+)
+
+// catalogBatch is the number of file records written to a catalog at once
+const catalogBatch = 100
+
+// catalogFields are the file record fields that catalog columns may be mapped to
+var catalogFields = map[string]func(doc sproket.Doc, path string) string{
+	"path":          func(doc sproket.Doc, path string) string { return path },
+	"instance_id":   func(doc sproket.Doc, path string) string { return doc.InstanceID },
+	"dataset_id":    func(doc sproket.Doc, path string) string { return doc.GetDatasetInstanceID() },
+	"version":       func(doc sproket.Doc, path string) string { return doc.GetDatasetVersion() },
+	"title":         func(doc sproket.Doc, path string) string { return doc.Title },
+	"data_node":     func(doc sproket.Doc, path string) string { return doc.DataNode },
+	"url":           func(doc sproket.Doc, path string) string { return doc.HTTPURL },
+	"checksum":      func(doc sproket.Doc, path string) string { return doc.GetSum() },
+	"checksum_type": func(doc sproket.Doc, path string) string { return doc.GetSumType() },
+	"size":          func(doc sproket.Doc, path string) string { return fmt.Sprintf("%d", doc.Size) },
+	"time":          func(doc sproket.Doc, path string) string { return time.Now().UTC().Format(time.RFC3339) },
+}
+
+// sqlIdentifier matches the table and column names accepted in a catalog
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// catalogConfig is the "catalog" section of the config file
+type catalogConfig struct {
+	Driver  string            `json:"driver"`
+	DSN     string            `json:"dsn"`
+	Table   string            `json:"table"`
+	Columns map[string]string `json:"columns"`
+}
+
+// catalog writes a record of every completed file into a table of a SQLite or PostgreSQL database,
+// through the sqlite3 or psql client so no database driver is needed
+type catalog struct {
+	conf    catalogConfig
+	client  string
+	columns []string
+	pathCol string
+	pending []string
+	mutex   sync.Mutex
+}
+
+// newCatalog validates the catalog config, a nil catalog is returned if none is configured
+func newCatalog(conf *catalogConfig) (*catalog, error) {
+	if conf == nil {
+		return nil, nil
+	}
+	c := catalog{conf: *conf}
+	switch conf.Driver {
+	case "sqlite", "sqlite3":
+		c.client = "sqlite3"
+	case "postgres", "postgresql":
+		c.client = "psql"
+	default:
+		return nil, fmt.Errorf("catalog driver must be sqlite or postgres, not %q", conf.Driver)
+	}
+	if _, err := exec.LookPath(c.client); err != nil {
+		return nil, fmt.Errorf("the %s catalog needs %s installed: %s", conf.Driver, c.client, err)
+	}
+	if conf.DSN == "" {
+		return nil, errors.New("catalog dsn is required, a database file for sqlite or a connection string for postgres")
+	}
+	if !(sqlIdentifier.MatchString(conf.Table)) {
+		return nil, fmt.Errorf("catalog table %q is not a valid table name", conf.Table)
+	}
+
+	// Without a mapping, columns are named after the fields
+	if len(conf.Columns) == 0 {
+		c.conf.Columns = make(map[string]string)
+		for field := range catalogFields {
+			c.conf.Columns[field] = field
+		}
+	}
+	for column, field := range c.conf.Columns {
+		if !(sqlIdentifier.MatchString(column)) || strings.Contains(column, ".") {
+			return nil, fmt.Errorf("catalog column %q is not a valid column name", column)
+		}
+		if _, in := catalogFields[field]; !(in) {
+			return nil, fmt.Errorf("catalog column %s maps to unknown field %q", column, field)
+		}
+		if field == "path" {
+			c.pathCol = column
+		}
+		c.columns = append(c.columns, column)
+	}
+	if c.pathCol == "" {
+		return nil, errors.New("catalog columns must map a column to path, which identifies each file")
+	}
+	sort.Strings(c.columns)
+	return &c, nil
+}
+
+// record queues the record of a file placed at dest, writing the queue once it is large enough
+func (c *catalog) record(doc sproket.Doc, dest string) {
+	if c == nil {
+		return
+	}
+	if abs, err := filepath.Abs(dest); err == nil && !(isObjectStore(dest)) {
+		dest = abs
+	}
+	var values []string
+	for _, column := range c.columns {
+		values = append(values, sqlString(catalogFields[c.conf.Columns[column]](doc, dest)))
+	}
+	// Replace any earlier record of the same file so the catalog mirrors the output directory
+	statement := fmt.Sprintf("DELETE FROM %s WHERE %s = %s;\nINSERT INTO %s (%s) VALUES (%s);\n",
+		c.conf.Table, c.pathCol, sqlString(dest),
+		c.conf.Table, strings.Join(c.columns, ", "), strings.Join(values, ", "))
+
+	c.mutex.Lock()
+	c.pending = append(c.pending, statement)
+	due := len(c.pending) >= catalogBatch
+	c.mutex.Unlock()
+	if due {
+		if err := c.flush(); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// flush writes the queued records in a single transaction
+func (c *catalog) flush() error {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.pending) == 0 {
+		return nil
+	}
+
+	script := fmt.Sprintf("BEGIN;\n%sCOMMIT;\n", strings.Join(c.pending, ""))
+	var cmd *exec.Cmd
+	if c.client == "sqlite3" {
+		cmd = exec.Command(c.client, "-bail", c.conf.DSN)
+	} else {
+		cmd = exec.Command(c.client, "-q", "-v", "ON_ERROR_STOP=1", c.conf.DSN)
+	}
+	cmd.Stdin = strings.NewReader(script)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("unable to write %d records to catalog table %s: %s %s", len(c.pending), c.conf.Table, err, strings.TrimSpace(stderr.String()))
+	}
+	c.pending = nil
+	return nil
+}
+
+// sqlString quotes a value as a SQL string literal
+func sqlString(value string) string {
+	return fmt.Sprintf("'%s'", strings.ReplaceAll(value, "'", "''"))
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// citedDataset gathers the manifest entries of a single dataset
+type citedDataset struct {
+	instanceID string
+	version    string
+	pids       map[string]bool
+	citations  map[string]bool
+	files      int
+	first      time.Time
+	last       time.Time
+}
+
+// cite writes a data availability statement for the datasets recorded in a manifest
+func cite(arguments []string) {
+	flags := flag.NewFlagSet("cite", flag.ExitOnError)
+	manifestPath := flags.String("manifest", "", "Path to the manifest written by -manifest during downloads")
+	outPath := flags.String("out", "", "Path to write the statement to, instead of stdout")
+	flags.Parse(arguments)
+	if *manifestPath == "" {
+		fmt.Println("-manifest is required, use sproket cite -h for help")
+		return
+	}
+
+	m, err := loadManifest(*manifestPath, ".")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(m.Files) == 0 {
+		fmt.Printf("%s does not record any files\n", *manifestPath)
+		return
+	}
+
+	var out io.Writer = os.Stdout
+	if *outPath != "" {
+		f, err := os.Create(*outPath)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer f.Close()
+		out = f
+	}
+	writeCitation(out, m)
+}
+
+// writeCitation writes the data availability statement for the manifest to out
+func writeCitation(out io.Writer, m *manifest) {
+
+	// Group files into their datasets
+	datasets := make(map[string]*citedDataset)
+	var first, last time.Time
+	for _, entry := range m.Files {
+		instanceID := entry.DatasetID
+		if instanceID == "" {
+			instanceID = "unknown dataset"
+		}
+		dataset, in := datasets[instanceID]
+		if !(in) {
+			dataset = &citedDataset{
+				instanceID: instanceID,
+				version:    entry.Version,
+				pids:       make(map[string]bool),
+				citations:  make(map[string]bool),
+				first:      entry.Time,
+				last:       entry.Time,
+			}
+			datasets[instanceID] = dataset
+		}
+		dataset.files++
+		for _, pid := range entry.PID {
+			dataset.pids[pid] = true
+		}
+		for _, citation := range entry.Citation {
+			dataset.citations[citation] = true
+		}
+		if entry.Time.Before(dataset.first) {
+			dataset.first = entry.Time
+		}
+		if entry.Time.After(dataset.last) {
+			dataset.last = entry.Time
+		}
+		if first.IsZero() || entry.Time.Before(first) {
+			first = entry.Time
+		}
+		if entry.Time.After(last) {
+			last = entry.Time
+		}
+	}
+	var instanceIDs []string
+	for instanceID := range datasets {
+		instanceIDs = append(instanceIDs, instanceID)
+	}
+	sort.Strings(instanceIDs)
+
+	indexNode := m.SearchAPI
+	if u, err := url.Parse(m.SearchAPI); err == nil && u.Host != "" {
+		indexNode = u.Host
+	}
+
+	fmt.Fprintln(out, "Data availability")
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "The data used in this work were obtained from the Earth System Grid Federation (ESGF) through the index node %s, ", indexNode)
+	fmt.Fprintf(out, "downloaded with sproket between %s and %s. ", first.Format("2006-01-02"), last.Format("2006-01-02"))
+	fmt.Fprintf(out, "The following %d datasets (%d files) were used:\n", len(datasets), len(m.Files))
+	for _, instanceID := range instanceIDs {
+		dataset := datasets[instanceID]
+		fmt.Fprintln(out)
+		if dataset.version != "" {
+			fmt.Fprintf(out, "%s (version %s)\n", dataset.instanceID, strings.TrimPrefix(dataset.version, "v"))
+		} else {
+			fmt.Fprintln(out, dataset.instanceID)
+		}
+		for _, pid := range sortedKeys(dataset.pids) {
+			fmt.Fprintf(out, "    PID: %s\n", pid)
+		}
+		for _, citation := range sortedKeys(dataset.citations) {
+			fmt.Fprintf(out, "    Citation: %s\n", citation)
+		}
+		fmt.Fprintf(out, "    Files: %d, downloaded %s to %s\n", dataset.files, dataset.first.Format("2006-01-02"), dataset.last.Format("2006-01-02"))
+	}
+}
+
+// sortedKeys returns the keys of a set in order
+func sortedKeys(set map[string]bool) []string {
+	var keys []string
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// planDiff holds the differences between an earlier plan and a newly computed one
+type planDiff struct {
+	added       []string
+	removed     []string
+	republished []string
+	replicas    []string
+	reordered   []string
+}
+
+// comparePlan resolves the search as a plan and compares it against the plan, written by -plan.out, or job file at path
+func comparePlan(args *config, path string) {
+	if _, err := os.Stat(path); err != nil {
+		fmt.Println(err)
+		return
+	}
+	old, err := loadJob(path)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	var tasks []*task
+	resolve(args, func(t *task) {
+		tasks = append(tasks, t)
+	})
+	tasks = selectTasks(args, tasks)
+
+	diff := diffPlans(old.Tasks, tasks)
+	diff.report(args, old, len(tasks))
+}
+
+// diffPlans compares the tasks of two plans by instance_id
+func diffPlans(oldTasks []*task, newTasks []*task) planDiff {
+	var diff planDiff
+	oldByID := make(map[string]*task)
+	for _, t := range oldTasks {
+		oldByID[t.InstanceID] = t
+	}
+	newByID := make(map[string]*task)
+	for _, t := range newTasks {
+		newByID[t.InstanceID] = t
+		prev, in := oldByID[t.InstanceID]
+		if !(in) {
+			diff.added = append(diff.added, t.InstanceID)
+			continue
+		}
+		oldNodes, newNodes := planDataNodes(prev), planDataNodes(t)
+		if prev.Docs[0].GetSum() != t.Docs[0].GetSum() {
+			diff.republished = append(diff.republished, t.InstanceID)
+		} else if !(sameSet(oldNodes, newNodes)) {
+			diff.replicas = append(diff.replicas, fmt.Sprintf("%s: %s -> %s", t.InstanceID, strings.Join(oldNodes, ","), strings.Join(newNodes, ",")))
+		} else if strings.Join(oldNodes, ",") != strings.Join(newNodes, ",") {
+			diff.reordered = append(diff.reordered, fmt.Sprintf("%s: %s -> %s", t.InstanceID, strings.Join(oldNodes, ","), strings.Join(newNodes, ",")))
+		}
+	}
+	for _, t := range oldTasks {
+		if _, in := newByID[t.InstanceID]; !(in) {
+			diff.removed = append(diff.removed, t.InstanceID)
+		}
+	}
+	for _, list := range [][]string{diff.added, diff.removed, diff.republished, diff.replicas, diff.reordered} {
+		sort.Strings(list)
+	}
+	return diff
+}
+
+// planDataNodes lists the data nodes of a task in order of preference
+func planDataNodes(t *task) []string {
+	var dataNodes []string
+	for _, doc := range t.Docs {
+		dataNodes = append(dataNodes, doc.DataNode)
+	}
+	return dataNodes
+}
+
+// sameSet reports whether a and b hold the same values, ignoring order
+func sameSet(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[string]int)
+	for _, value := range a {
+		counts[value]++
+	}
+	for _, value := range b {
+		counts[value]--
+		if counts[value] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// report outputs the differences, separating those caused by the index from those caused by sproket itself
+func (d planDiff) report(args *config, old *job, n int) {
+	oldVersion := old.Version
+	if oldVersion == "" {
+		oldVersion = "unknown"
+	}
+	fmt.Printf("comparing %d planned files against %d in a plan made %s by sproket %s, now %s\n", n, len(old.Tasks), old.Created.Format("2006-01-02 15:04"), oldVersion, VERSION)
+
+	indexChanges := len(d.added) + len(d.removed) + len(d.republished) + len(d.replicas)
+	fmt.Printf("index changes: %d files added, %d removed, %d republished with a new checksum, %d with different data nodes available\n", len(d.added), len(d.removed), len(d.republished), len(d.replicas))
+	fmt.Printf("client changes: %d files with the same data nodes preferred in a different order\n", len(d.reordered))
+	if indexChanges+len(d.reordered) == 0 {
+		fmt.Println("the plans are identical")
+		return
+	}
+	if oldVersion != VERSION && (len(d.added) != 0 || len(d.removed) != 0) {
+		fmt.Println("note: the sproket version changed, added or removed files may also come from changes to how sproket searches")
+	}
+
+	sections := []struct {
+		label string
+		items []string
+	}{
+		{"added", d.added},
+		{"removed", d.removed},
+		{"republished", d.republished},
+		{"replicas", d.replicas},
+		{"reordered", d.reordered},
+	}
+	for _, section := range sections {
+		for _, item := range section.items {
+			fmt.Printf("%s\t%s\n", section.label, item)
+		}
+	}
+}
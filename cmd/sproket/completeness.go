@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sproket"
+	"sync"
+)
+
+// datasetFiles tallies the files of a single dataset matching the search and those of them present locally
+type datasetFiles struct {
+	expected  int
+	size      int64
+	local     int
+	localSize int64
+	held      []heldFile
+}
+
+// heldFile is a verified download kept at its partial name until the rest of its dataset verifies
+type heldFile struct {
+	id    int
+	doc   sproket.Doc
+	path  string
+	final string
+}
+
+// completeness groups the files of a run by dataset, to report which datasets are complete locally. With
+// -require.complete verified files are only given their final names once every file of their dataset has verified
+type completeness struct {
+	require  bool
+	resolved bool
+	datasets map[string]*datasetFiles
+	mutex    sync.Mutex
+}
+
+func newCompleteness(require bool) *completeness {
+	return &completeness{require: require, datasets: make(map[string]*datasetFiles)}
+}
+
+// dataset returns the tally of the dataset doc belongs to, the mutex must be held
+func (c *completeness) dataset(doc sproket.Doc) *datasetFiles {
+	id := doc.GetDatasetInstanceID()
+	d, ok := c.datasets[id]
+	if !(ok) {
+		d = &datasetFiles{}
+		c.datasets[id] = d
+	}
+	return d
+}
+
+// expect counts a file matching the search, whether or not it is downloaded
+func (c *completeness) expect(doc sproket.Doc) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	d := c.dataset(doc)
+	d.expected++
+	d.size += doc.Size
+}
+
+// present counts a file found or placed in the output directory
+func (c *completeness) present(doc sproket.Doc) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	d := c.dataset(doc)
+	d.local++
+	d.localSize += doc.Size
+}
+
+// fromJob counts the files of a resumed job already done as present, the rest are counted as they are queued
+func (c *completeness) fromJob(j *job) {
+	if c == nil {
+		return
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	for _, t := range j.Tasks {
+		if t.Status == statusDone {
+			c.expect(t.Docs[0])
+			c.present(t.Docs[0])
+		}
+	}
+}
+
+// hold keeps back a verified file with -require.complete, returning the files of its dataset to place if it is now
+// complete. Files are not held otherwise, and are placed by the caller
+func (c *completeness) hold(id int, doc sproket.Doc, path string, final string) ([]heldFile, bool) {
+	if c == nil || !(c.require) {
+		return nil, false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	d := c.dataset(doc)
+	d.held = append(d.held, heldFile{id: id, doc: doc, path: path, final: final})
+	d.local++
+	d.localSize += doc.Size
+	if !(c.resolved) || d.local < d.expected {
+		return nil, true
+	}
+	release := d.held
+	d.held = nil
+	return release, true
+}
+
+// resolve marks every file of the search as counted, returning the held files of datasets that are complete
+func (c *completeness) resolve() []heldFile {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.resolved = true
+	var release []heldFile
+	for _, d := range c.datasets {
+		if d.local >= d.expected {
+			release = append(release, d.held...)
+			d.held = nil
+		}
+	}
+	return release
+}
+
+// place gives held files their final names, now their datasets are complete
+func (c *completeness) place(args *config, files []heldFile) {
+	for _, f := range files {
+		if err := moveFile(args, f.path, f.final); err != nil {
+			fmt.Printf("%d: %s\n", f.id, err)
+			continue
+		}
+		if args.verbose {
+			fmt.Printf("%d: removed postfix %s\n", f.id, f.final)
+		}
+		recordFile(f.id, f.doc, args, f.final)
+	}
+}
+
+// report summarizes the files of each dataset present locally, listing every dataset when verbose and otherwise
+// only those incomplete. Files of a job held back by -require.complete are left pending for a later run
+func (c *completeness) report(args *config) {
+	if c == nil || len(c.datasets) == 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var ids []string
+	for id := range c.datasets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	complete := 0
+	held := 0
+	heldIDs := make(map[string]bool)
+	for _, id := range ids {
+		d := c.datasets[id]
+		status := "complete"
+		if d.local >= d.expected {
+			complete++
+		} else {
+			status = "incomplete"
+		}
+		for _, f := range d.held {
+			heldIDs[f.doc.InstanceID] = true
+		}
+		held += len(d.held)
+		if args.verbose || d.local < d.expected {
+			fmt.Printf("%s\t%d of %d files\t%s of %s\t%s\n", id, d.local, d.expected, formatSize(d.localSize), formatSize(d.size), status)
+		}
+	}
+	fmt.Printf("%d of %d datasets complete locally\n", complete, len(ids))
+	if held == 0 {
+		return
+	}
+	fmt.Printf("%d verified files of incomplete datasets keep their .held names, as -require.complete is set\n", held)
+	if args.job != nil {
+		// Verifications still running update the tasks, so read them under the job's lock
+		args.job.mutex.Lock()
+		tasks := append([]*task(nil), args.job.Tasks...)
+		args.job.mutex.Unlock()
+		for _, t := range tasks {
+			if heldIDs[t.InstanceID] {
+				args.job.setStatus(t, statusPending)
+			}
+		}
+	}
+}
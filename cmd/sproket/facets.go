@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sproket"
+	"strings"
+)
+
+// facetSizeLimit is the most files read to total the size of each value, beyond it only counts are output
+const facetSizeLimit = 10000
+
+// facetValue holds the number of files with a value of a field, and their total size if it was found
+type facetValue struct {
+	Files int    `json:"files"`
+	Size  *int64 `json:"size,omitempty"`
+}
+
+// facetOutput is the JSON written by -facets
+type facetOutput struct {
+	SearchAPI string                           `json:"search_api"`
+	Files     int                              `json:"files"`
+	Size      *int64                           `json:"size,omitempty"`
+	Facets    map[string]map[string]facetValue `json:"facets"`
+	Federated bool                             `json:"federated,omitempty"`
+	Missing   []string                         `json:"missing,omitempty"`
+	Error     string                           `json:"error,omitempty"`
+}
+
+// outputFacets writes the values of each -facets field as JSON, with their file counts and, for result sets
+// of up to facetSizeLimit files, their total sizes
+func outputFacets(args *config) {
+	fields := splitList(args.facets)
+
+	// Ensure each file is only counted once
+	args.search.Fields["replica"] = "false"
+	_, n := args.search.SearchURLs(0, 0)
+	output := facetOutput{
+		SearchAPI: args.search.API.String(),
+		Files:     n,
+		Facets:    make(map[string]map[string]facetValue),
+		// The indexes' counts are added together, so a file more than one holds is counted for each
+		Federated: args.search.Federate,
+	}
+
+	ctx, cancel := searchContext(args)
+	defer cancel()
+	results, err := args.search.FacetsContext(ctx, fields)
+	var partial *sproket.PartialError
+	if errors.As(err, &partial) {
+		output.Missing = partial.Missing
+		output.Error = partial.Err.Error()
+	} else if err != nil {
+		output.Error = err.Error()
+	}
+	for field, valueCounts := range results {
+		values := make(map[string]facetValue)
+		for value, count := range valueCounts {
+			values[value] = facetValue{Files: count}
+		}
+		output.Facets[field] = values
+	}
+
+	if n <= facetSizeLimit && output.Error == "" && len(fields) != 0 {
+		sizeFacets(args, fields, &output)
+	}
+
+	fileBytes, err := json.MarshalIndent(output, "", "    ")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(string(fileBytes))
+}
+
+// sizeFacets totals the size of the files with each value, reading every file of the result set
+func sizeFacets(args *config, fields []string, output *facetOutput) {
+	search := args.search
+	search.FileFacets = fields
+	sizes := make(map[string]map[string]int64)
+	for _, field := range fields {
+		sizes[field] = make(map[string]int64)
+	}
+	var total int64
+	read := 0
+	pages := search.Pages(250)
+	for pages.Next() {
+		for _, doc := range pages.Docs() {
+			read++
+			total += doc.Size
+			for _, field := range fields {
+				if doc.Facets[field] == "" {
+					continue
+				}
+				for _, value := range strings.Split(doc.Facets[field], ",") {
+					sizes[field][value] += doc.Size
+				}
+			}
+		}
+	}
+	// Sizes missing some files would mislead, so leave them out
+	if read < output.Files {
+		return
+	}
+	output.Size = &total
+	for field, values := range output.Facets {
+		for value, counts := range values {
+			size := sizes[field][value]
+			counts.Size = &size
+			values[value] = counts
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"sproket"
+	"strings"
+	"time"
+)
+
+// defaultSearchAPI is the search API fetch uses when none is given
+const defaultSearchAPI = "https://esgf-node.llnl.gov/esg-search/search/"
+
+// fetch downloads and verifies a single file, named by its instance_id or HTTP URL, without a config file
+func fetch(arguments []string) {
+	var args config
+	flags := flag.NewFlagSet("fetch", flag.ExitOnError)
+	searchAPI := flags.String("search.api", defaultSearchAPI, "Search API to resolve the file with, a comma separated list is tried in order")
+	flags.StringVar(&args.outDir, "out.dir", ".", "Path to directory to put the download in")
+	flags.BoolVar(&args.noVerify, "no.verify", false, "Flag to skip checksum verification")
+	flags.BoolVar(&args.verbose, "verbose", false, "Flag to print more information")
+	flags.IntVar(&args.retries, "search.retries", 2, "Number of times to retry a failed search request")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: sproket fetch [flags] <instance_id|url>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(arguments)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return
+	}
+	target := flags.Arg(0)
+
+	if _, err := os.Stat(args.outDir); os.IsNotExist(err) {
+		fmt.Printf("directory %s does not exist\n", args.outDir)
+		return
+	}
+	args.search.API = sproket.Endpoints(splitList(*searchAPI))
+	args.search.Fields = make(map[string]string)
+	httpClient, err := sproket.NewHTTPClient(sproket.HTTPOptions{TLSReload: time.Hour})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	retry := sproket.RetryPolicy{Attempts: args.retries + 1, Backoff: 2 * time.Second}
+	args.search.Client = sproket.NewClient(httpClient, AGENT, retry)
+	args.hostSlots = newHostSlots(0)
+	args.gate, _ = newGate("")
+
+	var docs []sproket.Doc
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		docs, err = fetchURL(&args, target)
+	} else {
+		docs, err = fetchInstanceID(&args, target)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// Fail over to the next copy of the file, originals first
+	for _, doc := range docs {
+		_, err = getDoc(0, doc, &args, true)
+		if err == nil {
+			fmt.Println(destPath(&args, doc))
+			return
+		}
+		fmt.Println(err)
+	}
+	fmt.Printf("unable to fetch %s\n", target)
+}
+
+// fetchInstanceID finds every copy of the file with the instance_id, originals first
+func fetchInstanceID(args *config, instanceID string) ([]sproket.Doc, error) {
+	args.search.Fields["instance_id"] = fmt.Sprintf("%q", instanceID)
+	docs, _ := args.search.SearchURLs(0, 100)
+	var copies []sproket.Doc
+	for _, doc := range docs {
+		if doc.HTTPURL != "" {
+			copies = append(copies, doc)
+		}
+	}
+	if len(copies) == 0 {
+		return nil, fmt.Errorf("no file with instance_id %s is available over HTTP", instanceID)
+	}
+	sort.SliceStable(copies, func(i, j int) bool {
+		return !(copies[i].Replica) && copies[j].Replica
+	})
+	return copies, nil
+}
+
+// fetchURL looks up the file served at the URL so it can be verified, falling back to an unverified download
+func fetchURL(args *config, inURL string) ([]sproket.Doc, error) {
+	parsed, err := url.Parse(inURL)
+	if err != nil {
+		return nil, err
+	}
+	filename := path.Base(parsed.Path)
+	if filename == "." || filename == "/" {
+		return nil, fmt.Errorf("%s does not name a file", inURL)
+	}
+
+	args.search.Fields["title"] = fmt.Sprintf("%q", filename)
+	args.search.Fields["data_node"] = fmt.Sprintf("%q", parsed.Hostname())
+	docs, _ := args.search.SearchURLs(0, 100)
+	for _, doc := range docs {
+		if doc.HTTPURL == inURL {
+			return []sproket.Doc{doc}, nil
+		}
+	}
+
+	if !(args.noVerify) {
+		fmt.Printf("warning: %s is not in the index, it cannot be verified\n", inURL)
+		args.noVerify = true
+	}
+	doc := sproket.Doc{
+		URLs:       []string{fmt.Sprintf("%s|application/netcdf|%s", inURL, sproket.ServiceHTTP)},
+		InstanceID: filename,
+		DataNode:   parsed.Hostname(),
+		HTTPURL:    inURL,
+	}
+	return []sproket.Doc{doc}, nil
+}
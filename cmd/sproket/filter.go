@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sproket"
+	"strings"
+)
+
+// patternList collects the values of a repeatable pattern flag
+type patternList []string
+
+func (p *patternList) String() string {
+	return strings.Join(*p, " ")
+}
+
+func (p *patternList) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+// filenameFilter decides which files are queued based on their filenames
+type filenameFilter struct {
+	include []func(string) bool
+	exclude []func(string) bool
+}
+
+// newFilenameFilter compiles the include and exclude patterns, each a glob or a /regex/
+func newFilenameFilter(include patternList, exclude patternList) (*filenameFilter, error) {
+	var f filenameFilter
+	var err error
+	if f.include, err = compilePatterns(include); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = compilePatterns(exclude); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func compilePatterns(patterns patternList) ([]func(string) bool, error) {
+	var matchers []func(string) bool
+	for _, pattern := range patterns {
+		// Regular expressions are wrapped in slashes, like regex field values
+		if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid regular expression %s: %s", pattern, err)
+			}
+			matchers = append(matchers, re.MatchString)
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %s: %s", pattern, err)
+		}
+		glob := pattern
+		matchers = append(matchers, func(name string) bool {
+			matched, _ := path.Match(glob, name)
+			return matched
+		})
+	}
+	return matchers, nil
+}
+
+// allowed reports whether the file of doc should be queued
+func (f *filenameFilter) allowed(doc sproket.Doc) bool {
+	name := filename(doc)
+	if len(f.include) != 0 && !(matchAny(f.include, name)) {
+		return false
+	}
+	return !(matchAny(f.exclude, name))
+}
+
+func matchAny(matchers []func(string) bool, name string) bool {
+	for _, match := range matchers {
+		if match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// filename returns the filename of doc, from its title or otherwise its download URL
+func filename(doc sproket.Doc) string {
+	if doc.Title != "" {
+		return doc.Title
+	}
+	return path.Base(doc.HTTPURL)
+}
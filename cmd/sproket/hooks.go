@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"sproket"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hookFields are search fields that are never passed to hooks as facets, since sproket sets them itself
+var hookFields = map[string]bool{
+	"replica":    true,
+	"data_node":  true,
+	"latest":     true,
+	"retracted":  true,
+	"version":    true,
+	"dataset_id": true,
+}
+
+// hooks runs a command for every file downloaded and sends a summary once the run completes
+type hooks struct {
+	exec        string
+	notifyURL   string
+	notifyEmail string
+	smtp        string
+	started     time.Time
+	completed   int
+	downloaded  int
+	bytes       int64
+	mutex       sync.Mutex
+}
+
+// runSummary is the summary of a run sent to -notify.url
+type runSummary struct {
+	SearchAPI  string    `json:"search_api"`
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+	Completed  int       `json:"completed"`
+	Downloaded int       `json:"downloaded"`
+	Bytes      int64     `json:"bytes"`
+	Failed     []string  `json:"failed"`
+}
+
+// newHooks returns the hooks, or nil if none are configured. The search fields, and -hook.facets, are fetched
+// for each file so they can be passed to the command
+func newHooks(args *config) *hooks {
+	if args.hookExec == "" && args.notifyURL == "" && args.notifyEmail == "" {
+		return nil
+	}
+	if args.hookExec != "" {
+		requested := make(map[string]bool)
+		for field := range args.search.Fields {
+			field = strings.TrimPrefix(field, "-")
+			if !(hookFields[field]) && !(requested[field]) {
+				args.search.FileFacets = append(args.search.FileFacets, field)
+				requested[field] = true
+			}
+		}
+		for _, field := range splitList(args.hookFacets) {
+			if !(requested[field]) {
+				args.search.FileFacets = append(args.search.FileFacets, field)
+				requested[field] = true
+			}
+		}
+	}
+	return &hooks{
+		exec:        args.hookExec,
+		notifyURL:   args.notifyURL,
+		notifyEmail: args.notifyEmail,
+		smtp:        args.notifySMTP,
+		started:     time.Now().UTC(),
+	}
+}
+
+// taskDone counts a file completed during the run, whether downloaded or already present
+func (h *hooks) taskDone() {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.completed++
+}
+
+// fileDone runs -hook.exec for a file just downloaded and verified, at path
+func (h *hooks) fileDone(id int, doc sproket.Doc, path string) {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	h.downloaded++
+	h.bytes += doc.Size
+	h.mutex.Unlock()
+	if h.exec == "" {
+		return
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", h.exec)
+	} else {
+		cmd = exec.Command("sh", "-c", h.exec)
+	}
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("SPROKET_PATH=%s", path),
+		fmt.Sprintf("SPROKET_INSTANCE_ID=%s", doc.InstanceID),
+		fmt.Sprintf("SPROKET_DATASET_ID=%s", doc.GetDatasetInstanceID()),
+		fmt.Sprintf("SPROKET_VERSION=%s", doc.GetDatasetVersion()),
+		fmt.Sprintf("SPROKET_DATA_NODE=%s", doc.DataNode),
+		fmt.Sprintf("SPROKET_URL=%s", doc.HTTPURL),
+		fmt.Sprintf("SPROKET_CHECKSUM=%s", doc.GetSum()),
+		fmt.Sprintf("SPROKET_CHECKSUM_TYPE=%s", doc.GetSumType()),
+		fmt.Sprintf("SPROKET_SIZE=%d", doc.Size),
+	)
+	for field, value := range doc.Facets {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("SPROKET_FACET_%s=%s", strings.ToUpper(field), value))
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Printf("%d: hook failed for %s: %s\n", id, path, err)
+	}
+}
+
+// notify sends the summary of the run to -notify.url and -notify.email
+func (h *hooks) notify(args *config) {
+	if h == nil || (h.notifyURL == "" && h.notifyEmail == "") {
+		return
+	}
+	args.failed.mutex.Lock()
+	failed := len(args.failed.tasks)
+	args.failed.mutex.Unlock()
+	h.mutex.Lock()
+	// Searches of -watch that found nothing new are not worth a notification
+	quiet := args.watch && h.completed == 0 && failed == 0
+	h.mutex.Unlock()
+	if quiet {
+		return
+	}
+	h.mutex.Lock()
+	summary := runSummary{
+		SearchAPI:  args.search.API.String(),
+		Started:    h.started,
+		Finished:   time.Now().UTC(),
+		Completed:  h.completed,
+		Downloaded: h.downloaded,
+		Bytes:      h.bytes,
+		Failed:     []string{},
+	}
+	h.mutex.Unlock()
+	args.failed.mutex.Lock()
+	for _, t := range args.failed.tasks {
+		summary.Failed = append(summary.Failed, t.InstanceID)
+	}
+	args.failed.mutex.Unlock()
+	sort.Strings(summary.Failed)
+
+	if h.notifyURL != "" {
+		if err := postSummary(args, h.notifyURL, summary); err != nil {
+			fmt.Printf("unable to notify %s: %s\n", h.notifyURL, err)
+		}
+	}
+	if h.notifyEmail != "" {
+		if err := mailSummary(h.smtp, h.notifyEmail, summary); err != nil {
+			fmt.Printf("unable to email %s: %s\n", h.notifyEmail, err)
+		}
+	}
+}
+
+// reset starts counting a new run
+func (h *hooks) reset() {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.started = time.Now().UTC()
+	h.completed, h.downloaded, h.bytes = 0, 0, 0
+}
+
+// postSummary posts the summary as JSON to a webhook
+func postSummary(args *config, webhook string, summary runSummary) error {
+	body, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", AGENT)
+	resp, err := args.search.Client.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// mailSummary emails the summary through the SMTP server at addr
+func mailSummary(addr string, to string, summary runSummary) error {
+	host, _ := os.Hostname()
+	from := fmt.Sprintf("sproket@%s", host)
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\n", from, to)
+	fmt.Fprintf(&msg, "Subject: sproket run finished: %d completed, %d failed\r\n\r\n", summary.Completed, len(summary.Failed))
+	fmt.Fprintf(&msg, "Search API: %s\r\n", summary.SearchAPI)
+	fmt.Fprintf(&msg, "Started: %s\r\nFinished: %s\r\n", summary.Started.Format(time.RFC3339), summary.Finished.Format(time.RFC3339))
+	fmt.Fprintf(&msg, "Completed: %d files, %d downloaded this run (%s)\r\n", summary.Completed, summary.Downloaded, formatSize(summary.Bytes))
+	if len(summary.Failed) != 0 {
+		fmt.Fprintf(&msg, "\r\n%d files failed:\r\n", len(summary.Failed))
+		for _, instanceID := range summary.Failed {
+			fmt.Fprintf(&msg, "%s\r\n", instanceID)
+		}
+	}
+	return smtp.SendMail(addr, nil, from, []string{to}, []byte(msg.String()))
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sproket"
+	"strconv"
+	"strings"
+)
+
+// interactiveShown is the most values listed at once, a filter narrows down longer lists
+const interactiveShown = 50
+
+// interactiveSizeLimit is the most datasets summed to show the size of the selection
+const interactiveSizeLimit = 1000
+
+// browser drills into the values of a list of fields, narrowing the search at each level
+type browser struct {
+	args     *config
+	fields   []string
+	selected []map[string]bool
+	base     map[string]string
+	level    int
+	filter   string
+	shown    []string
+	in       *bufio.Scanner
+}
+
+// interactive browses the facets of the search and downloads the chosen selection
+func interactive(args *config) {
+	if args.conf == "-" {
+		fmt.Println("-interactive reads commands from stdin, the config can not be read from stdin too")
+		return
+	}
+	fields := splitList(args.interactiveFields)
+	if len(fields) == 0 {
+		fmt.Println("-interactive.fields requires at least one field")
+		return
+	}
+	b := browser{
+		args:   args,
+		fields: fields,
+		base:   make(map[string]string),
+		in:     bufio.NewScanner(os.Stdin),
+	}
+	for key, value := range args.search.Fields {
+		b.base[key] = value
+	}
+	// Ensure each file is only counted once
+	b.base["replica"] = "false"
+	for range fields {
+		b.selected = append(b.selected, make(map[string]bool))
+	}
+
+	fmt.Println("enter ? for help")
+	b.show()
+	for {
+		fmt.Print("> ")
+		if !(b.in.Scan()) {
+			fmt.Println()
+			return
+		}
+		command := strings.TrimSpace(b.in.Text())
+		switch {
+		case command == "?" || command == "help":
+			b.help()
+		case command == "q" || command == "quit":
+			return
+		case command == "" || command == "n":
+			if b.level < len(b.fields)-1 {
+				b.level++
+				b.filter = ""
+			}
+			b.show()
+		case command == "b":
+			if b.level > 0 {
+				b.level--
+				b.filter = ""
+			}
+			b.show()
+		case command == "a":
+			for _, value := range b.shown {
+				b.selected[b.level][value] = true
+			}
+			b.show()
+		case command == "c":
+			b.selected[b.level] = make(map[string]bool)
+			b.show()
+		case strings.HasPrefix(command, "/"):
+			b.filter = strings.TrimPrefix(command, "/")
+			b.show()
+		case strings.HasPrefix(command, "w "):
+			b.write(strings.TrimSpace(strings.TrimPrefix(command, "w ")))
+		case command == "d":
+			if b.download() {
+				return
+			}
+		default:
+			if err := b.toggle(command); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			b.show()
+		}
+	}
+}
+
+// help lists the commands
+func (b *browser) help() {
+	fmt.Println("  1 3 5-7   toggle the numbered values")
+	fmt.Println("  a         select every listed value")
+	fmt.Println("  c         clear the selection of this field")
+	fmt.Println("  /text     only list values containing text, / to list them all")
+	fmt.Println("  n, enter  next field")
+	fmt.Println("  b         previous field")
+	fmt.Println("  w path    write a config file with the selection")
+	fmt.Println("  d         download the selection")
+	fmt.Println("  q         quit")
+}
+
+// fieldsUpTo returns the search fields with the selections of the levels before level applied
+func (b *browser) fieldsUpTo(level int) map[string]string {
+	fields := make(map[string]string)
+	for key, value := range b.base {
+		fields[key] = value
+	}
+	for i := 0; i < level; i++ {
+		var values []string
+		for value := range b.selected[i] {
+			values = append(values, value)
+		}
+		if len(values) == 0 {
+			continue
+		}
+		sort.Strings(values)
+		fields[b.fields[i]] = sproket.TermMatch(values)
+	}
+	return fields
+}
+
+// show lists the values of the current field and summarizes the selection so far
+func (b *browser) show() {
+	field := b.fields[b.level]
+	b.args.search.Fields = b.fieldsUpTo(b.level)
+	valueCounts := facet(b.args, field)
+
+	var values []string
+	for value := range valueCounts {
+		if strings.Contains(strings.ToLower(value), strings.ToLower(b.filter)) {
+			values = append(values, value)
+		}
+	}
+	sort.Strings(values)
+	hidden := 0
+	if len(values) > interactiveShown {
+		hidden = len(values) - interactiveShown
+		values = values[:interactiveShown]
+	}
+	b.shown = values
+
+	var path []string
+	for i := 0; i <= b.level; i++ {
+		path = append(path, b.fields[i])
+	}
+	fmt.Printf("\n%s (%d values)\n", strings.Join(path, " > "), len(valueCounts))
+	for i, value := range values {
+		mark := " "
+		if b.selected[b.level][value] {
+			mark = "x"
+		}
+		fmt.Printf("  [%s] %3d) %-40s %d files\n", mark, i+1, value, valueCounts[value])
+	}
+	if hidden > 0 {
+		fmt.Printf("  ... %d more, use /text to filter\n", hidden)
+	}
+	b.summary()
+}
+
+// summary prints the number of files and size of the current selection
+func (b *browser) summary() {
+	b.args.search.Fields = b.fieldsUpTo(len(b.fields))
+	_, n := b.args.search.SearchURLs(0, 0)
+	_, datasets := b.args.search.SearchDatasets(0, 0)
+	if datasets > interactiveSizeLimit {
+		fmt.Printf("selection: %d files in %d datasets\n", n, datasets)
+		return
+	}
+	var size int64
+	limit := 250
+	for cur := 0; ; cur += limit {
+		page, remaining := b.args.search.SearchDatasets(cur, limit)
+		for _, dataset := range page {
+			size += dataset.Size
+		}
+		if remaining == 0 || len(page) == 0 {
+			break
+		}
+	}
+	fmt.Printf("selection: %d files in %d datasets, %s\n", n, datasets, formatSize(size))
+}
+
+// toggle flips the selection of the values numbered in command, like "1 3 5-7"
+func (b *browser) toggle(command string) error {
+	var picks []int
+	for _, part := range strings.Fields(command) {
+		first, last := part, part
+		if dash := strings.Index(part, "-"); dash > 0 {
+			first, last = part[:dash], part[dash+1:]
+		}
+		from, err := strconv.Atoi(first)
+		if err != nil {
+			return fmt.Errorf("unrecognized command %s, enter ? for help", command)
+		}
+		to, err := strconv.Atoi(last)
+		if err != nil || from < 1 || to > len(b.shown) || from > to {
+			return fmt.Errorf("%s is not between 1 and %d", part, len(b.shown))
+		}
+		for i := from; i <= to; i++ {
+			picks = append(picks, i-1)
+		}
+	}
+	for _, pick := range picks {
+		value := b.shown[pick]
+		if b.selected[b.level][value] {
+			delete(b.selected[b.level], value)
+		} else {
+			b.selected[b.level][value] = true
+		}
+	}
+	return nil
+}
+
+// write saves the config file with its fields replaced by the selection, to run again later without -interactive
+func (b *browser) write(path string) {
+	conf := make(map[string]interface{})
+	fileBytes, err := ioutil.ReadFile(b.args.conf)
+	if err == nil {
+		err = json.Unmarshal(fileBytes, &conf)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	// Only the drilled into fields change, defaults filled in by Init are left out
+	fields, _ := conf["fields"].(map[string]interface{})
+	if fields == nil {
+		fields = make(map[string]interface{})
+	}
+	selection := b.fieldsUpTo(len(b.fields))
+	for _, field := range b.fields {
+		if value, in := selection[field]; in {
+			fields[field] = value
+		}
+	}
+	conf["fields"] = fields
+	fileBytes, err = json.MarshalIndent(conf, "", "    ")
+	if err == nil {
+		err = ioutil.WriteFile(path, fileBytes, 0644)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("wrote %s\n", path)
+}
+
+// download runs the download of the selection once confirmed, reporting whether it ran
+func (b *browser) download() bool {
+	b.args.search.Fields = b.fieldsUpTo(len(b.fields))
+	_, n := b.args.search.SearchURLs(0, 0)
+	if n == 0 {
+		fmt.Println("no files are selected")
+		return false
+	}
+	fmt.Printf("download %d files to %s? [y/N] ", n, b.args.outDir)
+	if !(b.in.Scan()) {
+		return false
+	}
+	answer := strings.ToLower(strings.TrimSpace(b.in.Text()))
+	if answer != "y" && answer != "yes" {
+		return false
+	}
+	b.args.confirm = true
+	getBySearch(b.args)
+	return true
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Statuses of a task within a job
+const (
+	statusPending = "pending"
+	statusDone    = "done"
+	statusFailed  = "failed"
+)
+
+// jobSaveInterval is the minimum time between intermediate saves of a job during a run
+const jobSaveInterval = 30 * time.Second
+
+// job records the resolved tasks of a run and how far each one has got, so a later run can resume it
+type job struct {
+	Version  string    `json:"sproket_version"`
+	Created  time.Time `json:"created"`
+	Resolved bool      `json:"resolved"`
+	Tasks    []*task   `json:"tasks"`
+	path     string
+	lastSave time.Time
+	mutex    sync.Mutex
+}
+
+// loadJob reads the job at path, or starts a new one if none exists yet
+func loadJob(path string) (*job, error) {
+	j := job{
+		Version:  VERSION,
+		Created:  time.Now().UTC(),
+		path:     path,
+		lastSave: time.Now(),
+	}
+	fileBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &j, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(fileBytes, &j); err != nil {
+		return nil, fmt.Errorf("%s is not a valid job file: %s", path, err)
+	}
+	return &j, nil
+}
+
+// resolved reports whether the search for this job already completed
+func (j *job) resolved() bool {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.Resolved
+}
+
+// add records a resolved task, the job counts as resolved once it is saved after the search
+func (j *job) add(t *task) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.Tasks = append(j.Tasks, t)
+}
+
+// pending returns the tasks that have not completed, failed tasks are attempted again
+func (j *job) pending() []*task {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	var pending []*task
+	for _, t := range j.Tasks {
+		if t.Status != statusDone {
+			pending = append(pending, t)
+		}
+	}
+	return pending
+}
+
+// setStatus records the outcome of a task, saving the job periodically
+func (j *job) setStatus(t *task, status string) {
+	j.mutex.Lock()
+	t.Status = status
+	due := time.Since(j.lastSave) > jobSaveInterval
+	j.mutex.Unlock()
+	if due {
+		if err := j.save(); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// save writes the job, replacing the previous copy only once it is completely written
+func (j *job) save() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.Resolved = true
+	j.lastSave = time.Now()
+	fileBytes, err := json.MarshalIndent(j, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.tmp", j.path)
+	if err := ioutil.WriteFile(tmp, fileBytes, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
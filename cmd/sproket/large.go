@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Actions for files larger than -large.size
+const (
+	largeConfirm = "confirm"
+	largeDefer   = "defer"
+	largeSkip    = "skip"
+)
+
+// largeFiles applies the -large.size rules to tasks before they are queued
+type largeFiles struct {
+	threshold int64
+	action    string
+	queuePath string
+	queue     *job
+	held      []*task
+	heldSize  int64
+}
+
+func newLargeFiles(threshold int64, action string, queuePath string) (*largeFiles, error) {
+	switch action {
+	case largeConfirm, largeSkip:
+	case largeDefer:
+		if queuePath == "" {
+			return nil, fmt.Errorf("-large.action defer requires -large.queue")
+		}
+	default:
+		return nil, fmt.Errorf("unrecognized -large.action: %s", action)
+	}
+	return &largeFiles{threshold: threshold, action: action, queuePath: queuePath}, nil
+}
+
+// confirm asks whether files over the threshold should be downloaded, if the action calls for it
+func (l *largeFiles) confirm(args *config) {
+	if l.threshold <= 0 || l.action != largeConfirm || args.urlsOnly || args.noDownload {
+		return
+	}
+	// -y confirms large files too, and without a terminal there is no one to ask
+	if args.confirm || !(stdinTerminal()) {
+		l.threshold = 0
+		return
+	}
+	args.search.Fields["size"] = fmt.Sprintf("[%d TO *]", l.threshold+1)
+	_, n := args.search.SearchURLs(0, 0)
+	delete(args.search.Fields, "size")
+	if n == 0 {
+		l.threshold = 0
+		return
+	}
+
+	fmt.Printf("%d files are larger than %s, download them too? [y/N] ", n, formatSize(l.threshold))
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	if answer == "y" || answer == "yes" {
+		l.threshold = 0
+		return
+	}
+	l.action = largeSkip
+}
+
+// stdinTerminal reports whether stdin is a terminal that can be asked for confirmation
+func stdinTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// screen wraps emit, holding back tasks for files over the threshold
+func (l *largeFiles) screen(emit func(t *task)) func(t *task) {
+	if l.threshold <= 0 {
+		return emit
+	}
+	return func(t *task) {
+		if t.Docs[0].Size <= l.threshold {
+			emit(t)
+			return
+		}
+		l.held = append(l.held, t)
+		l.heldSize += t.Docs[0].Size
+	}
+}
+
+// report lists the held back files, writing them to the deferred queue if desired
+func (l *largeFiles) report(args *config) {
+	if len(l.held) == 0 {
+		return
+	}
+	verb := "skipped"
+	if l.action == largeDefer {
+		var err error
+		l.queue, err = loadJob(l.queuePath)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		for _, t := range l.held {
+			l.queue.add(t)
+		}
+		if err := l.queue.save(); err != nil {
+			fmt.Println(err)
+			return
+		}
+		verb = fmt.Sprintf("deferred to the job %s", l.queuePath)
+	}
+	fmt.Printf("%d files larger than %s (%s in total) %s\n", len(l.held), formatSize(l.threshold), formatSize(l.heldSize), verb)
+	if args.verbose {
+		for _, t := range l.held {
+			fmt.Printf("%s\t%s\n", t.InstanceID, formatSize(t.Docs[0].Size))
+		}
+	}
+}
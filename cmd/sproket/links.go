@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sproket"
+	"strings"
+)
+
+// linker places files by linking to verified copies already downloaded elsewhere, rather than downloading them again
+type linker struct {
+	symbolic   bool
+	dirs       []string
+	bySum      map[string]string
+	byInstance map[string]string
+}
+
+// newLinker indexes the verified copies recorded in the manifests and checksum lists of earlier output directories
+func newLinker(mode string, from string) (*linker, error) {
+	if mode != "hard" && mode != "sym" {
+		return nil, fmt.Errorf("-link must be hard or sym, not %s", mode)
+	}
+	l := linker{
+		symbolic:   mode == "sym",
+		bySum:      make(map[string]string),
+		byInstance: make(map[string]string),
+	}
+	for _, dir := range splitList(from) {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		if info, err := os.Stat(abs); err != nil || !(info.IsDir()) {
+			return nil, fmt.Errorf("-link.from %s is not a directory", dir)
+		}
+		l.dirs = append(l.dirs, abs)
+
+		m, err := loadManifest(filepath.Join(abs, "sproket_manifest.json"), abs)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range m.Files {
+			path := filepath.Join(abs, filepath.FromSlash(entry.Path))
+			l.byInstance[entry.InstanceID] = path
+			if entry.Checksum != "" {
+				l.bySum[strings.ToLower(entry.Checksum)] = path
+			}
+		}
+		for _, name := range []string{"sha256sums.txt", "md5sums.txt"} {
+			l.readSums(abs, name)
+		}
+	}
+	if len(l.dirs) == 0 {
+		return nil, errors.New("-link needs -link.from, the output directories of earlier downloads")
+	}
+	return &l, nil
+}
+
+// readSums indexes the files listed in a checksum list written by -sums
+func (l *linker) readSums(dir string, name string) {
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		sum, rel, found := strings.Cut(scanner.Text(), "  ")
+		if found {
+			l.bySum[strings.ToLower(sum)] = filepath.Join(dir, filepath.FromSlash(rel))
+		}
+	}
+}
+
+// source finds a verified copy of the file of doc. Recorded copies are trusted if their size still matches,
+// files merely named like the instance_id in an output directory are verified first
+func (l *linker) source(doc sproket.Doc, dest string) string {
+	recorded := []string{l.bySum[strings.ToLower(doc.GetSum())], l.byInstance[doc.InstanceID]}
+	for _, path := range recorded {
+		if path == "" || path == dest {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil && (doc.Size == 0 || info.Size() == doc.Size) {
+			return path
+		}
+	}
+	for _, dir := range l.dirs {
+		path := filepath.Join(dir, fileName(doc.InstanceID))
+		if path == dest {
+			continue
+		}
+		if _, err := os.Stat(path); err == nil && check(path, doc.GetSum(), doc.GetSumType()) == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// link places the file of doc at dest by linking to a verified copy, reporting whether it did
+func (l *linker) link(id int, doc sproket.Doc, args *config, dest string) bool {
+	if l == nil {
+		return false
+	}
+	source := l.source(doc, dest)
+	if source == "" {
+		return false
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return false
+	}
+	os.Remove(dest)
+	var err error
+	if l.symbolic {
+		err = os.Symlink(source, dest)
+	} else {
+		err = os.Link(source, dest)
+	}
+	// Hard links can not cross filesystems, the file is downloaded instead
+	if err != nil {
+		if args.verbose {
+			fmt.Printf("%d: unable to link %s to %s, downloading instead: %s\n", id, dest, source, err)
+		}
+		return false
+	}
+	if args.verbose {
+		fmt.Printf("%d: linked %s to %s, no download\n", id, dest, source)
+	}
+	return true
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/md5"
 	"crypto/sha256"
 	"encoding/json"
@@ -9,13 +10,15 @@ import (
 	"hash"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"sproket"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // VERSION is the current version of sproket
@@ -25,30 +28,123 @@ var VERSION = "v0.2.14"
 var AGENT = fmt.Sprintf("sproket/%s", VERSION)
 
 type config struct {
-	conf             string
-	outDir           string
-	valuesFor        string
-	parallel         int
-	noDownload       bool
-	urlsOnly         bool
-	verbose          bool
-	confirm          bool
-	count            bool
-	noVerify         bool
-	version          bool
-	fieldKeys        bool
-	displayDataNodes bool
-	softDataNode     bool
-	unsafe           bool
-	search           sproket.Search
+	conf              string
+	outDir            string
+	valuesFor         string
+	parallel          int
+	noDownload        bool
+	urlsOnly          bool
+	verbose           bool
+	confirm           bool
+	count             bool
+	noVerify          bool
+	version           bool
+	fieldKeys         bool
+	displayDataNodes  bool
+	facets            string
+	softDataNode      bool
+	unsafe            bool
+	probe             bool
+	probeMerge        bool
+	failover          bool
+	chunks            int
+	tlsReload         time.Duration
+	connectTimeout    time.Duration
+	readTimeout       time.Duration
+	proxy             string
+	noHTTP2           bool
+	window            string
+	gate              *gate
+	excludeDataNodes  string
+	onlyDataNodes     string
+	filterDataNodes   bool
+	shardDepth        int
+	manifestPath      string
+	manifest          *manifest
+	catalog           *catalog
+	store             *objectStore
+	hookExec          string
+	hookFacets        string
+	notifyURL         string
+	notifyEmail       string
+	notifySMTP        string
+	hooks             *hooks
+	verifyParallel    int
+	verifier          *verifier
+	linkMode          string
+	linkFrom          string
+	links             *linker
+	audit             bool
+	cacheDir          string
+	cacheTTL          time.Duration
+	stageDir          string
+	noFsync           bool
+	names             *names
+	requireComplete   bool
+	completeness      *completeness
+	protocolList      string
+	protocols         *protocols
+	partialsAge       time.Duration
+	interactive       bool
+	interactiveFields string
+	auditOut          string
+	watch             bool
+	interval          time.Duration
+	sumsType          string
+	sums              *checksumList
+	jobPath           string
+	planCompare       string
+	plan              bool
+	planOut           string
+	job               *job
+	failed            failedQueue
+	datasets          bool
+	datasetIDs        string
+	dataVersion       string
+	hostParallel      int
+	hostSlots         *hostSlots
+	searchTimeout     time.Duration
+	searchBackoff     time.Duration
+	retries           int
+	searchRate        float64
+	start             string
+	end               string
+	bbox              string
+	query             string
+	include           patternList
+	exclude           patternList
+	filter            *filenameFilter
+	largeSize         string
+	largeAction       string
+	largeQueue        string
+	large             *largeFiles
+	maxBytes          string
+	maxQueue          string
+	budget            *budget
+	limit             int
+	offset            int
+	order             string
+	sample            int
+	seed              int64
+	search            sproket.Search
 }
 
 func (args *config) Init() error {
 
-	// Load config file
-	fileBytes, err := ioutil.ReadFile(args.conf)
-	if err != nil {
-		return fmt.Errorf("%s not found", args.conf)
+	// Load config file, "-" reads it from stdin so generated criteria can be piped in
+	var fileBytes []byte
+	var err error
+	if args.conf == "-" {
+		args.conf = "stdin"
+		fileBytes, err = ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("unable to read config from stdin: %s", err)
+		}
+	} else {
+		fileBytes, err = ioutil.ReadFile(args.conf)
+		if err != nil {
+			return fmt.Errorf("%s not found", args.conf)
+		}
 	}
 
 	// Validate JSON
@@ -58,30 +154,343 @@ func (args *config) Init() error {
 
 	// Load JSON config
 	json.Unmarshal(fileBytes, &args.search)
-	if args.search.API == "" {
+	if len(args.search.API) == 0 {
 		return fmt.Errorf("search_api is required parameter in config file")
 	}
 
-	// Hard set special fields
+	// Hard set special fields, a pinned version is allowed to be superseded or retracted
 	args.search.Fields["replica"] = "*"
 	args.search.Fields["data_node"] = "*"
-	if !(args.unsafe) {
+	if args.dataVersion != "" {
+		args.search.Version = args.dataVersion
+	}
+	args.search.Version = strings.TrimPrefix(args.search.Version, "v")
+	if args.search.Version != "" && args.search.Version != "all" {
+		args.search.Fields["version"] = args.search.Version
+	}
+	if !(args.unsafe) && args.search.Version == "" {
 		args.search.Fields["retracted"] = "false"
 		args.search.Fields["latest"] = "true"
 	}
 
 	args.softDataNode = (len(args.search.DataNodePriority) != 0)
 
-	// Configure HTTP settings
-	args.search.Agent = AGENT
-	args.search.HTTPClient = &http.Client{}
+	if args.query != "" {
+		args.search.Query = args.query
+	}
+
+	// Time and space ranges from the command line override those in the config file
+	if args.start != "" {
+		args.search.Start = args.start
+	}
+	if args.end != "" {
+		args.search.End = args.end
+	}
+	if args.bbox != "" {
+		args.search.BBox = nil
+		for _, value := range splitList(args.bbox) {
+			degrees, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("invalid bbox value %s", value)
+			}
+			args.search.BBox = append(args.search.BBox, degrees)
+		}
+	}
+	if err := args.search.ValidateRanges(); err != nil {
+		return err
+	}
+
+	args.filter, err = newFilenameFilter(args.include, args.exclude)
+	if err != nil {
+		return err
+	}
+
+	// Watching runs unattended, so nothing waits on an answer and new files are downloaded without confirmation
+	if args.watch {
+		if args.jobPath != "" {
+			return fmt.Errorf("-watch searches again every -interval, it can not resume a -job")
+		}
+		if args.interval <= 0 {
+			return fmt.Errorf("-interval must be positive")
+		}
+		// confirm is the default, so only an explicit one is asking for an answer that can not be given
+		if args.largeAction == largeConfirm {
+			if setFlags()["large.action"] {
+				return fmt.Errorf("-watch runs unattended, so -large.action %s can not ask, use %s or %s", largeConfirm, largeSkip, largeDefer)
+			}
+			args.largeAction = largeSkip
+		}
+		args.confirm = true
+	}
+
+	switch args.order {
+	case "", orderSizeAsc, orderSizeDesc, orderName:
+	default:
+		return fmt.Errorf("-order must be %s, %s or %s, not %s", orderSizeAsc, orderSizeDesc, orderName, args.order)
+	}
+
+	threshold, err := parseSize(args.largeSize)
+	if err != nil {
+		return err
+	}
+	args.large, err = newLargeFiles(threshold, args.largeAction, args.largeQueue)
+	if err != nil {
+		return err
+	}
+	args.budget, err = newBudget(args.maxBytes, args.maxQueue)
+	if err != nil {
+		return err
+	}
+
+	// Expand selected datasets to their files
+	if instanceIDs := splitList(args.datasetIDs); len(instanceIDs) != 0 {
+		args.search.Fields["dataset_id"] = sproket.DatasetMatch(instanceIDs)
+	}
 
-	if _, err := os.Stat(args.outDir); os.IsNotExist(err) {
+	// Data node filters from the command line add to those in the config file
+	args.search.DataNodeExclude = append(args.search.DataNodeExclude, splitList(args.excludeDataNodes)...)
+	args.search.DataNodeOnly = append(args.search.DataNodeOnly, splitList(args.onlyDataNodes)...)
+	args.filterDataNodes = (len(args.search.DataNodeExclude) != 0 || len(args.search.DataNodeOnly) != 0)
+
+	// Configure HTTP settings, flags override the config file
+	httpOpts := sproket.HTTPOptions{
+		TLS: sproket.TLSFiles{
+			CABundle:   args.search.CABundle,
+			ClientCert: args.search.ClientCert,
+			ClientKey:  args.search.ClientKey,
+		},
+		TLSReload:    args.tlsReload,
+		Proxy:        args.search.Proxy,
+		Connections:  args.parallel * args.chunks,
+		DisableHTTP2: args.noHTTP2 || (args.search.HTTP2 != nil && !(*args.search.HTTP2)),
+	}
+	httpOpts.ConnectTimeout, err = durationSetting("connect_timeout", args.search.ConnectTimeout, args.connectTimeout)
+	if err != nil {
+		return err
+	}
+	httpOpts.ReadTimeout, err = durationSetting("read_timeout", args.search.ReadTimeout, args.readTimeout)
+	if err != nil {
+		return err
+	}
+	if args.proxy != "" {
+		httpOpts.Proxy = args.proxy
+	}
+	httpClient, err := sproket.NewHTTPClient(httpOpts)
+	if err != nil {
+		return err
+	}
+	retry := sproket.RetryPolicy{Attempts: args.retries + 1, Backoff: args.searchBackoff}
+	args.search.Client = sproket.NewClient(httpClient, AGENT, retry)
+	if args.searchRate < 0 {
+		return fmt.Errorf("-search.rate must not be negative")
+	}
+	args.search.Client.Limit = sproket.NewRateLimit(args.searchRate)
+	if args.cacheDir != "" {
+		if err := os.MkdirAll(args.cacheDir, 0755); err != nil {
+			return err
+		}
+		args.search.Client.Cache = sproket.NewCache(args.cacheDir, args.cacheTTL)
+	}
+
+	if isObjectStore(args.outDir) {
+		if args.chunks > 1 {
+			return fmt.Errorf("-chunks is not supported when storing to %s", args.outDir)
+		}
+		args.store, err = newObjectStore(args.outDir, args.search.Client)
+		if err != nil {
+			return err
+		}
+	} else if _, err := os.Stat(args.outDir); os.IsNotExist(err) {
 		return fmt.Errorf("directory %s does not exist", args.outDir)
 	}
+	if args.stageDir != "" {
+		if args.store != nil {
+			return fmt.Errorf("-stage.dir is not supported when storing to %s", args.outDir)
+		}
+		if _, err := os.Stat(args.stageDir); os.IsNotExist(err) {
+			return fmt.Errorf("directory %s does not exist", args.stageDir)
+		}
+	}
+
+	args.protocols, err = newProtocols(args.protocolList, &args.search)
+	if err != nil {
+		return err
+	}
+	if args.store != nil && args.protocols.needs(sproket.ServiceGridFTP) {
+		return fmt.Errorf("%s is not supported when storing to %s", sproket.ServiceGridFTP, args.outDir)
+	}
+
+	if args.requireComplete && args.store != nil {
+		return fmt.Errorf("-require.complete is not supported when storing to %s", args.outDir)
+	}
+	args.completeness = newCompleteness(args.requireComplete)
+
+	args.hostSlots = newHostSlots(args.hostParallel)
+	args.gate, err = newGate(args.window)
+	if err != nil {
+		return err
+	}
+	// Pausing only applies to downloads, the handlers are registered once as -watch dispatches every cycle
+	if !(args.urlsOnly) && !(args.noDownload) {
+		notifyPause(args.gate)
+	}
+
+	if err := absDirs(args); err != nil {
+		return err
+	}
+
+	// Sharded output is only navigable through the manifest, and -watch finds new files by it, so always keep one
+	if args.shardDepth < 0 || args.shardDepth > 4 {
+		return fmt.Errorf("-shard.depth must be between 0 and 4")
+	}
+	if (args.shardDepth > 0 || args.watch) && args.manifestPath == "" {
+		args.manifestPath = filepath.Join(args.outDir, "sproket_manifest.json")
+		if args.store != nil {
+			args.manifestPath = "sproket_manifest.json"
+		}
+	}
+	if args.manifestPath != "" {
+		args.manifest, err = loadManifest(args.manifestPath, args.outDir)
+		if err != nil {
+			return err
+		}
+		args.manifest.SearchAPI = args.search.API.String()
+	}
+	namesDir := args.outDir
+	if args.store != nil {
+		namesDir = ""
+	}
+	args.names, err = newNames(namesDir, args.manifest)
+	if err != nil {
+		return err
+	}
+
+	// The catalog is configured alongside the search, in its own section
+	var sections struct {
+		Catalog *catalogConfig `json:"catalog"`
+	}
+	json.Unmarshal(fileBytes, &sections)
+	args.catalog, err = newCatalog(sections.Catalog)
+	if err != nil {
+		return err
+	}
+	args.hooks = newHooks(args)
+
+	if args.linkMode != "" {
+		if args.store != nil {
+			return fmt.Errorf("-link is not supported when storing to %s", args.outDir)
+		}
+		args.links, err = newLinker(args.linkMode, args.linkFrom)
+		if err != nil {
+			return err
+		}
+	}
+
+	if args.sumsType != "" {
+		if args.store != nil {
+			return fmt.Errorf("-sums is not supported when storing to %s", args.outDir)
+		}
+		args.sums, err = newChecksumList(args.sumsType, args.outDir)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// durationSetting returns the duration set by flag, or else by the config file setting name
+func durationSetting(name string, value string, flag time.Duration) (time.Duration, error) {
+	if flag != 0 || value == "" {
+		return flag, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %s, expected a duration like 30s", name, value)
+	}
+	return duration, nil
+}
+
+// searchContext returns a context that ends after -search.timeout, if there is one
+func searchContext(args *config) (context.Context, context.CancelFunc) {
+	if args.searchTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), args.searchTimeout)
+}
+
+// facet returns the values of the field and their file counts, giving up after -search.timeout
+func facet(args *config, field string) map[string]int {
+	return facetOf(args, &args.search, field)
+}
+
+// facetOf is facet for another search, such as a copy of the search with different fields
+func facetOf(args *config, search *sproket.Search, field string) map[string]int {
+	ctx, cancel := searchContext(args)
+	defer cancel()
+	valueCounts, err := search.FacetContext(ctx, field)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return valueCounts
+}
+
+// splitList splits a comma separated list, ignoring empty entries
+func splitList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// allowedDataNode reports whether files may be downloaded from the data node given the data node filters
+func allowedDataNode(args *config, dataNode string) bool {
+	for _, excluded := range args.search.DataNodeExclude {
+		if dataNode == excluded {
+			return false
+		}
+	}
+	if len(args.search.DataNodeOnly) == 0 {
+		return true
+	}
+	for _, only := range args.search.DataNodeOnly {
+		if dataNode == only {
+			return true
+		}
+	}
+	return false
+}
+
+// hostSlots limits the number of concurrent downloads from each data node
+type hostSlots struct {
+	limit int
+	slots map[string]chan struct{}
+	mutex sync.Mutex
+}
+
+func newHostSlots(limit int) *hostSlots {
+	return &hostSlots{limit: limit, slots: make(map[string]chan struct{})}
+}
+
+// acquire waits for a free download slot on the data node and returns the function that frees it again
+func (h *hostSlots) acquire(dataNode string) func() {
+	if h.limit <= 0 {
+		return func() {}
+	}
+	h.mutex.Lock()
+	slots, in := h.slots[dataNode]
+	if !(in) {
+		slots = make(chan struct{}, h.limit)
+		h.slots[dataNode] = slots
+	}
+	h.mutex.Unlock()
+	slots <- struct{}{}
+	return func() { <-slots }
+}
+
 func getHasher(dest string, remoteSum string, remoteSumType string) (hash.Hash, error) {
 	if remoteSumType == "" || remoteSum == "" {
 		return nil, fmt.Errorf("could not retrieve checksum for %s", dest)
@@ -96,17 +505,23 @@ func getHasher(dest string, remoteSum string, remoteSumType string) (hash.Hash,
 	}
 }
 
-func check(dest string, remoteSum string, remoteSumType string) error {
-	hash, err := getHasher(dest, remoteSum, remoteSumType)
+// hashFile writes the contents of the file at path to the hash
+func hashFile(path string, h hash.Hash) error {
+	f, err := os.Open(path)
 	if err != nil {
 		return err
 	}
-	f, err := os.Open(dest)
+	defer f.Close()
+	_, err = io.Copy(h, f)
+	return err
+}
+
+func check(dest string, remoteSum string, remoteSumType string) error {
+	hash, err := getHasher(dest, remoteSum, remoteSumType)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	if _, err := io.Copy(hash, f); err != nil {
+	if err := hashFile(dest, hash); err != nil {
 		return err
 	}
 	res := fmt.Sprintf("%x", hash.Sum(nil))
@@ -116,94 +531,388 @@ func check(dest string, remoteSum string, remoteSumType string) error {
 	return nil
 }
 
-func getData(id int, inDocs <-chan sproket.Doc, waiter *sync.WaitGroup, args *config) {
+// task is a single file to retrieve, holding a document for each candidate data node from most to least preferred
+type task struct {
+	InstanceID string        `json:"instance_id"`
+	Docs       []sproket.Doc `json:"docs"`
+	Status     string        `json:"status"`
+	next       int
+	checked    bool
+}
+
+func newTask(docs []sproket.Doc) *task {
+	return &task{InstanceID: docs[0].InstanceID, Docs: docs, Status: statusPending}
+}
+
+// failedQueue collects the tasks that could not be completed during a run
+type failedQueue struct {
+	tasks []*task
+	mutex sync.Mutex
+}
+
+// add records a failed task, marking it failed in the job so a resumed job attempts it again
+func (q *failedQueue) add(args *config, t *task) {
+	if args.job != nil {
+		args.job.setStatus(t, statusFailed)
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.tasks = append(q.tasks, t)
+}
+
+// report lists the failed tasks, if any
+func (q *failedQueue) report() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.tasks) == 0 {
+		return
+	}
+	fmt.Printf("%d files failed:\n", len(q.tasks))
+	for _, t := range q.tasks {
+		fmt.Println(t.InstanceID)
+	}
+}
+
+func getData(id int, inTasks <-chan *task, waiter *sync.WaitGroup, args *config) {
 	defer waiter.Done()
-	for doc := range inDocs {
-		// Report download when verbose
+	for t := range inTasks {
+		getTask(id, t, args)
+	}
+}
+
+// getTask handles a single task, a panic only fails this task rather than bringing down the whole run
+func getTask(id int, t *task, args *config) {
+	handedOff := false
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("%d: internal error handling %s: %v\n", id, t.InstanceID, r)
+			args.failed.add(args, t)
+		}
+		// The task is over unless a verification worker has taken it on
+		if !(handedOff) {
+			args.verifier.done()
+		}
+	}()
+
+	doc := t.Docs[0]
+	// Report URLs only, if applicable
+	if args.urlsOnly {
+		fmt.Println(preferredURL(args, doc))
+	} else if args.noDownload {
+		// Do nothing in no download, except report if verbose
 		if args.verbose {
-			fmt.Printf("%d: download %s\n", id, doc.HTTPURL)
-		}
-		// Report URLs only, if applicable
-		if args.urlsOnly {
-			fmt.Println(doc.HTTPURL)
-		} else if args.noDownload {
-			// Do nothing in no download, except report if verbose
-			if args.verbose {
-				fmt.Printf("%d: no download\n", id)
-			}
-		} else { // Do the download
-			// Build filenames
-			destName := filepath.Join(args.outDir, fmt.Sprintf("%s.part", doc.InstanceID))
-			finalDestName := filepath.Join(args.outDir, doc.InstanceID)
-
-			// Check if file is already present and correct
-			if _, err := os.Stat(finalDestName); err == nil {
-				err = check(finalDestName, doc.GetSum(), doc.GetSumType())
-				// Go to next download if everything checks out
-				if err == nil {
-					if args.verbose {
-						fmt.Printf("%d: %s already present and verified, no download\n", id, finalDestName)
-					}
-					continue
+			fmt.Printf("%d: download %s\n", id, preferredURL(args, doc))
+			fmt.Printf("%d: no download\n", id)
+		}
+	} else { // Do the download, failing over to the next data node on error
+		for i := t.next; i < len(t.Docs); i++ {
+			v, err := getDoc(id, t.Docs[i], args, !(t.checked))
+			if err == nil {
+				// Files still to be hashed are finished by a verification worker
+				if v != nil {
+					v.t, v.index = t, i
+					handedOff = true
+					args.verifier.submit(v)
+					return
 				}
+				finishTask(args, t)
+				return
 			}
-
-			// Create the destination file
-			fileWriter, err := os.Create(destName)
-			if err != nil {
-				fmt.Printf("%d: unable to create %s: %s\n", id, destName, err)
-				continue
+			fmt.Printf("%d: %s\n", id, err)
+			if i+1 < len(t.Docs) {
+				fmt.Printf("%d: failing over to %s\n", id, t.Docs[i+1].DataNode)
 			}
-			defer fileWriter.Close()
-
-			// Create destination writer and set the default writer
-			var dest io.Writer
-			dest = fileWriter
-
-			// Create hash for potential later use
-			h, hashErr := getHasher(finalDestName, doc.GetSum(), doc.GetSumType())
-			if hashErr != nil && !(args.noVerify) {
-				fmt.Printf("%d: hash warning: %s\n", id, hashErr)
-			} else if !(args.noVerify) {
-				// Write to both the file and the hash in memory, not parallel though
-				dest = io.MultiWriter(h, fileWriter)
+		}
+		args.failed.add(args, t)
+	}
+}
+
+// finishTask records a task as completed
+func finishTask(args *config, t *task) {
+	if args.job != nil {
+		args.job.setStatus(t, statusDone)
+	}
+	args.hooks.taskDone()
+}
+
+// getDoc downloads the file of doc, returning a verification instead if the file is left for a verification worker to hash
+func getDoc(id int, doc sproket.Doc, args *config, checkExisting bool) (*verification, error) {
+	// Report download when verbose
+	if args.verbose {
+		fmt.Printf("%d: download %s\n", id, doc.HTTPURL)
+	}
+
+	// Objects are streamed to the object store without touching local disk
+	if args.store != nil {
+		return nil, getObject(id, doc, args)
+	}
+
+	// Build filenames
+	finalDestName := destPath(args, doc)
+	destName := partPath(args, doc)
+
+	// Check if file is already present and correct
+	if _, err := os.Stat(finalDestName); err == nil && checkExisting {
+		if args.verifier.offload() {
+			return &verification{path: finalDestName, final: finalDestName, existing: true}, nil
+		}
+		err = check(finalDestName, doc.GetSum(), doc.GetSumType())
+		// Go to next download if everything checks out
+		if err == nil {
+			presentFile(id, doc, args, finalDestName)
+			return nil, nil
+		}
+	}
+
+	// A file held back by -require.complete in an earlier run is not downloaded again
+	if held := heldPath(args, doc); checkExisting && args.requireComplete {
+		if _, err := os.Stat(held); err == nil && check(held, doc.GetSum(), doc.GetSumType()) == nil {
+			return nil, placeFile(id, doc, args, held, finalDestName)
+		}
+	}
+
+	// Link to a copy downloaded by an earlier search, if there is one
+	if args.links.link(id, doc, args, finalDestName) {
+		args.completeness.present(doc)
+		recordFile(id, doc, args, finalDestName)
+		return nil, nil
+	}
+
+	// Create any shard directories, safe to race with other workers
+	if err := os.MkdirAll(filepath.Dir(destName), 0755); err != nil {
+		return nil, fmt.Errorf("unable to create directory for %s: %s", destName, err)
+	}
+
+	// Respect the per data node limit on concurrent downloads
+	release := args.hostSlots.acquire(doc.DataNode)
+	defer release()
+
+	// Create hash for potential later use
+	h, hashErr := getHasher(finalDestName, doc.GetSum(), doc.GetSumType())
+	if hashErr != nil && !(args.noVerify) {
+		fmt.Printf("%d: hash warning: %s\n", id, hashErr)
+	}
+	verify := (hashErr == nil && !(args.noVerify))
+
+	// Hold off until downloads are allowed
+	args.gate.wait()
+
+	// Perform download, falling back through the preferred protocols the data node offers
+	accesses := args.protocols.access(doc)
+	if len(accesses) == 0 {
+		return nil, fmt.Errorf("%s offers none of the -protocols for %s", doc.DataNode, doc.InstanceID)
+	}
+	var streamed bool
+	var err error
+	for i, access := range accesses {
+		if i > 0 {
+			fmt.Printf("%d: %s\n%d: falling back to %s\n", id, err, id, access.Service)
+		}
+		if h != nil {
+			h.Reset()
+		}
+		streamed, err = transfer(args, access, destName, h, verify)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Downloads not streamed through the hash can only be hashed once complete
+	if !(streamed) && verify {
+		if args.verifier.offload() {
+			return &verification{path: destName, final: finalDestName}, nil
+		}
+		if err := hashFile(destName, h); err != nil {
+			return nil, err
+		}
+	}
+
+	// Verify checksum, if available and desired
+	if verify {
+		verified := (fmt.Sprintf("%x", h.Sum(nil)) == doc.GetSum())
+		if !(verified) {
+			// A resumable segmented download must not resume from corrupt chunks
+			if args.chunks > 1 {
+				sproket.RemoveChunked(destName)
 			}
+			return nil, fmt.Errorf("checksum verification failure for %s", finalDestName)
+		} else if args.verbose {
+			fmt.Printf("%d: verified %s\n", id, destName)
+		}
+	}
 
-			// Perform download
-			err = args.search.Get(doc.HTTPURL, dest)
-			fileWriter.Close()
-			if err != nil {
-				fmt.Printf("%d: an error occurred during download of %s:\n\t%s\n", id, doc.HTTPURL, err)
-				continue
+	// Rename the file to indicate it is verified
+	if hashErr == nil || args.noVerify {
+		return nil, placeFile(id, doc, args, destName, finalDestName)
+	}
+	return nil, nil
+}
+
+// transfer downloads the file at access to destName, reporting whether it was streamed through the hash
+func transfer(args *config, access sproket.AccessURL, destName string, h hash.Hash, verify bool) (bool, error) {
+	if access.Service == sproket.ServiceGridFTP {
+		if err := gridFTP(access.URL, destName); err != nil {
+			return false, fmt.Errorf("an error occurred during download of %s:\n\t%s", access.URL, err)
+		}
+		return false, nil
+	}
+
+	// Segmented downloads can only be hashed once reassembled. One stopped by the gate closing resumes
+	// from its completed chunks once downloads are allowed again
+	if args.chunks > 1 {
+		for {
+			args.gate.wait()
+			ctx, cancel := args.gate.open()
+			err := args.search.Client.GetChunkedContext(ctx, access.URL, destName, args.chunks)
+			closed := (ctx.Err() != nil)
+			cancel()
+			if err == nil {
+				return false, nil
 			}
+			if !(closed) {
+				return false, fmt.Errorf("an error occurred during download of %s:\n\t%s", access.URL, err)
+			}
+			fmt.Printf("downloads paused, %s resumes from its completed chunks\n", destName)
+		}
+	}
 
-			// Verify checksum, if available and desired
-			if hashErr == nil && !(args.noVerify) {
-				verified := (fmt.Sprintf("%x", h.Sum(nil)) == doc.GetSum())
-				if !(verified) {
-					fmt.Printf("checksum verification failure for %s", finalDestName)
-					continue
-				} else if args.verbose {
-					fmt.Printf("%d: verified %s\n", id, destName)
-				}
+	// Create the destination file
+	fileWriter, err := os.Create(destName)
+	if err != nil {
+		return false, fmt.Errorf("unable to create %s: %s", destName, err)
+	}
+	defer fileWriter.Close()
+
+	// Create destination writer and set the default writer
+	var dest io.Writer
+	dest = fileWriter
+	if verify {
+		// Write to both the file and the hash in memory, not parallel though
+		dest = io.MultiWriter(h, fileWriter)
+	}
+
+	// A transfer stopped by the gate closing resumes with a range request for the rest of the file
+	for {
+		args.gate.wait()
+		offset, err := fileWriter.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return false, err
+		}
+		ctx, cancel := args.gate.open()
+		ranged, err := args.search.Client.GetFromContext(ctx, access.URL, offset, dest)
+		closed := (ctx.Err() != nil)
+		cancel()
+		if err == nil && ranged {
+			return true, fileWriter.Close()
+		}
+		if err == nil {
+			// The server sent the whole file rather than the rest of it, so start over
+			if err := restartFile(fileWriter, h); err != nil {
+				return false, err
 			}
+			continue
+		}
+		if !(closed) {
+			return false, fmt.Errorf("an error occurred during download of %s:\n\t%s", access.URL, err)
+		}
+		offset, _ = fileWriter.Seek(0, io.SeekCurrent)
+		fmt.Printf("downloads paused, %s resumes from byte %d\n", destName, offset)
+	}
+}
 
-			// Rename the file to indicate it is verified
-			if hashErr == nil || args.noVerify {
-				err = os.Rename(destName, finalDestName)
-				if err != nil {
-					fmt.Println(err)
-					continue
-				} else if args.verbose {
-					fmt.Printf("%d: removed postfix %s\n", id, finalDestName)
-				}
+// restartFile empties a partial download and the hash of it so the transfer can start over
+func restartFile(f *os.File, h hash.Hash) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if h != nil {
+		h.Reset()
+	}
+	return nil
+}
+
+// presentFile records a file found already present and verified
+func presentFile(id int, doc sproket.Doc, args *config, finalDestName string) {
+	if args.verbose {
+		fmt.Printf("%d: %s already present and verified, no download\n", id, finalDestName)
+	}
+	if args.manifest != nil {
+		args.manifest.record(doc, finalDestName)
+	}
+	args.catalog.record(doc, finalDestName)
+	args.sums.record(doc, finalDestName)
+	args.completeness.present(doc)
+}
+
+// placeFile moves a verified download to its final name and records it, unless it is held back until its dataset
+// is complete
+func placeFile(id int, doc sproket.Doc, args *config, destName string, finalDestName string) error {
+	if args.requireComplete {
+		// Held files are renamed so they are never taken for abandoned partial downloads
+		if held := heldPath(args, doc); destName != held {
+			if err := os.Rename(destName, held); err != nil {
+				return err
 			}
+			destName = held
+		}
+	}
+	if release, held := args.completeness.hold(id, doc, destName, finalDestName); held {
+		if args.verbose {
+			fmt.Printf("%d: holding %s until its dataset is complete\n", id, destName)
 		}
+		args.completeness.place(args, release)
+		return nil
+	}
+	args.completeness.present(doc)
+	err := moveFile(args, destName, finalDestName)
+	if err != nil {
+		return err
+	} else if args.verbose {
+		fmt.Printf("%d: removed postfix %s\n", id, finalDestName)
+	}
+	recordFile(id, doc, args, finalDestName)
+	return nil
+}
+
+// recordFile records a file newly placed in the output directory
+func recordFile(id int, doc sproket.Doc, args *config, finalDestName string) {
+	if args.manifest != nil {
+		args.manifest.record(doc, finalDestName)
 	}
+	args.catalog.record(doc, finalDestName)
+	args.sums.record(doc, finalDestName)
+	args.hooks.fileDone(id, doc, finalDestName)
 }
 
 func getBySearch(args *config) {
 
+	// A job that was already resolved resumes without searching again
+	if args.jobPath != "" {
+		var err error
+		args.job, err = loadJob(args.jobPath)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if args.job.resolved() {
+			pending := orderTasks(args, args.job.pending())
+			fmt.Printf("resuming job %s: %d of %d files remaining\n", args.jobPath, len(pending), len(args.job.Tasks))
+			args.completeness.fromJob(args.job)
+			dispatch(args, len(pending), taskDataNodes(pending), func(taskChan chan<- *task) {
+				for _, t := range pending {
+					taskChan <- t
+				}
+			})
+			return
+		}
+	}
+
 	// Count original files, only files with "replica: false" entries present in the index will be downloaded
 	args.search.Fields["replica"] = "false"
 	if args.verbose {
@@ -211,24 +920,238 @@ func getBySearch(args *config) {
 	}
 	_, n := args.search.SearchURLs(0, 0)
 	if !(args.urlsOnly) {
-		fmt.Printf("found %d files for download\n", n)
+		if args.search.Federate {
+			fmt.Printf("found at most %d files for download, the federated indexes' counts are added together and may include the same files\n", n)
+		} else {
+			fmt.Printf("found %d files for download\n", n)
+		}
+	}
+	if args.search.Version != "" && n != 0 {
+		warnVersion(args)
+	}
+	if args.planCompare != "" {
+		comparePlan(args, args.planCompare)
+		return
+	}
+	if args.plan || args.planOut != "" {
+		makePlan(args)
+		return
 	}
 	if args.count || n == 0 {
 		return
 	}
 	warnCount := 100
-	if !(args.confirm) && n > warnCount {
-		fmt.Printf("too many files (%d > %d): confirm larger download by specifying the -y option or refine search criteria\n", n, warnCount)
+	if selected := selectedCount(args, n); !(args.confirm) && selected > warnCount {
+		fmt.Printf("too many files (%d > %d): confirm larger download by specifying the -y option or refine search criteria\n", selected, warnCount)
 		return
 	}
 
+	// Selections and new jobs need every task resolved before any download starts
+	// Ordering needs them all too
+	if args.job != nil || args.selecting() || args.order != "" {
+		var tasks []*task
+		resolve(args, func(t *task) {
+			tasks = append(tasks, t)
+		})
+		tasks = orderTasks(args, selectTasks(args, tasks))
+		if args.job != nil {
+			for _, t := range tasks {
+				args.job.add(t)
+			}
+			if err := args.job.save(); err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+		dispatch(args, len(tasks), taskDataNodes(tasks), func(taskChan chan<- *task) {
+			for _, t := range tasks {
+				taskChan <- t
+			}
+		})
+		return
+	}
+
+	dispatch(args, n, countDataNodes(args), func(taskChan chan<- *task) {
+		resolve(args, func(t *task) {
+			taskChan <- t
+		})
+	})
+}
+
+// warnVersion warns about files in the result set that are not the latest version or are retracted
+func warnVersion(args *config) {
+	// Both counts are independent, so they are searched for at once
+	var superseded, retracted int
+	waiter := sync.WaitGroup{}
+	waiter.Add(2)
+	go func() {
+		defer waiter.Done()
+		_, superseded = args.search.WithFields(map[string]string{"latest": "false"}).SearchURLs(0, 0)
+	}()
+	go func() {
+		defer waiter.Done()
+		_, retracted = args.search.WithFields(map[string]string{"retracted": "true"}).SearchURLs(0, 0)
+	}()
+	waiter.Wait()
+
+	if superseded != 0 {
+		fmt.Printf("warning: %d files are not the latest version of their dataset\n", superseded)
+	}
+	if retracted != 0 {
+		fmt.Printf("warning: %d files have been retracted, they should not be used for new work\n", retracted)
+	}
+}
+
+// taskDataNodes counts the data nodes that may serve the tasks
+func taskDataNodes(tasks []*task) int {
+	dataNodes := make(map[string]bool)
+	for _, t := range tasks {
+		for _, doc := range t.Docs {
+			dataNodes[doc.DataNode] = true
+		}
+	}
+	return len(dataNodes)
+}
+
+// countDataNodes counts the allowed data nodes that may serve files matching the search, when a per data node limit needs it
+func countDataNodes(args *config) int {
+	if args.hostParallel <= 0 {
+		return 0
+	}
+	if args.softDataNode || args.filterDataNodes || args.failover {
+		args.search.Fields["replica"] = "*"
+	}
+	count := 0
+	for dataNode := range facet(args, "data_node") {
+		if allowedDataNode(args, dataNode) {
+			count++
+		}
+	}
+	args.search.Fields["replica"] = "false"
+	return count
+}
+
+// workerCount caps the number of download workers to what the files and data nodes can keep busy
+func workerCount(args *config, files int, dataNodes int) int {
+	workers := args.parallel
+	if files < workers {
+		workers = files
+	}
+	if args.hostParallel > 0 && dataNodes*args.hostParallel < workers {
+		workers = dataNodes * args.hostParallel
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	if workers != args.parallel && !(args.urlsOnly) {
+		fmt.Printf("using %d concurrent downloads for %d files, instead of -p %d\n", workers, files, args.parallel)
+	} else if args.verbose {
+		fmt.Printf("using %d concurrent downloads\n", workers)
+	}
+	return workers
+}
+
+// dispatch starts the download workers, feeds them the tasks sent by submit and waits for them to finish
+func dispatch(args *config, files int, dataNodes int, submit func(taskChan chan<- *task)) {
+
+	// Partial downloads abandoned long ago will not be resumed
+	if !(args.urlsOnly) && !(args.noDownload) {
+		cleanPartials(args)
+	}
+
+	if wait := args.gate.untilOpen(time.Now()); wait > 0 && !(args.urlsOnly) && !(args.noDownload) {
+		fmt.Printf("outside the download window %s, downloads start in %s\n", args.window, wait.Round(time.Minute))
+	}
+
+	taskChan := make(chan *task)
+	args.verifier = newVerifier(args, taskChan)
+	waiter := sync.WaitGroup{}
+	workers := workerCount(args, files, dataNodes)
+	for id := 0; id < workers; id++ {
+		waiter.Add(1)
+		go getData(id, taskChan, &waiter, args)
+	}
+
+	// Tasks are counted as they are submitted, those failed over by verification workers come back around.
+	// Submitted tasks are queued in order, until the -max.bytes budget is spent. Only the files queued count
+	// towards the completeness of their datasets
+	submitted := make(chan *task)
+	forwarded := make(chan struct{})
+	go func() {
+		for t := range submitted {
+			if !(args.budget.allow(t)) {
+				continue
+			}
+			args.completeness.expect(t.Docs[0])
+			args.verifier.add()
+			taskChan <- t
+		}
+		close(forwarded)
+	}()
+	submit(submitted)
+	close(submitted)
+	<-forwarded
+	args.completeness.place(args, args.completeness.resolve())
+	args.verifier.wait()
+	close(taskChan)
+	waiter.Wait()
+	args.verifier.close()
+	args.failed.report()
+	args.budget.report(args)
+	if !(args.urlsOnly) && !(args.noDownload) {
+		args.completeness.report(args)
+	}
+
+	if args.manifest != nil {
+		if err := args.manifest.save(); err != nil {
+			fmt.Println(err)
+		}
+	}
+	if args.job != nil {
+		if err := args.job.save(); err != nil {
+			fmt.Println(err)
+		}
+	}
+	if err := args.names.save(); err != nil {
+		fmt.Println(err)
+	}
+	if err := args.catalog.flush(); err != nil {
+		fmt.Println(err)
+	}
+	if err := args.sums.close(); err != nil {
+		fmt.Println(err)
+	}
+	args.hooks.notify(args)
+}
+
+// resolve finds the documents of every file matching the search and emits a task for each, choosing data nodes as it goes
+func resolve(args *config, emit func(t *task)) {
+
+	// Hold back files over -large.size, unless confirmed
+	args.large.confirm(args)
+	emit = args.large.screen(emit)
+	defer args.large.report(args)
+
+	// Rank data nodes by probing them, if desired
+	if args.probe {
+		rankDataNodes(args)
+	}
+
 	// Check if the soft data node list will even matter
 	dataNodeMatches := make(map[string]bool)
-	if args.softDataNode {
+	if args.softDataNode || args.filterDataNodes || args.failover {
 		// Check for any matching replica data nodes in data node priority list
 		args.search.Fields["replica"] = "true"
-		dataNodes := args.search.Facet("data_node")
+		dataNodes := facet(args, "data_node")
 		for dataNode := range dataNodes {
+			if !(allowedDataNode(args, dataNode)) {
+				continue
+			}
+			// Any allowed replica may stand in for an original on a filtered or failed data node
+			if args.filterDataNodes || args.failover {
+				dataNodeMatches[dataNode] = true
+				continue
+			}
 			for _, preferedDataNode := range args.search.DataNodePriority {
 				if dataNode == preferedDataNode {
 					dataNodeMatches[dataNode] = true
@@ -239,101 +1162,231 @@ func getBySearch(args *config) {
 			fmt.Println("matching data nodes:")
 			fmt.Println(dataNodeMatches)
 		}
-		if len(dataNodeMatches) == 0 {
+		if len(dataNodeMatches) == 0 && !(args.filterDataNodes) && !(args.failover) {
 			args.softDataNode = false
+		} else {
+			args.softDataNode = true
 		}
 		// Reset replica to false
 		args.search.Fields["replica"] = "false"
 	}
 
-	// Setup download workers in case data node does not matter and for later
-	docChan := make(chan sproket.Doc)
-	waiter := sync.WaitGroup{}
-	for id := 0; id < args.parallel; id++ {
-		waiter.Add(1)
-		go getData(id, docChan, &waiter, args)
+	// Get documents that are all originals and assurred to be the true latest files. The replicas of each page
+	// are found as it arrives, so downloads start without waiting for the whole result set to be resolved
+	var replicas *replicaLookup
+	if args.softDataNode && len(dataNodeMatches) != 0 {
+		replicas = newReplicaLookup(args, dataNodeMatches)
 	}
-
-	// Get documents that are all originals and assurred to be the true latest files
-	allDocs := make(map[string]map[string]sproket.Doc)
+	var counts choiceCounts
+	// Federated indexes page independently, so the same file may turn up on different pages
+	emitted := make(map[string]bool)
+	filtered := 0
+	known := 0
 	limit := 250
-	for cur := 0; ; cur += limit {
-		docs, remaining := args.search.SearchURLs(cur, limit)
-		for _, doc := range docs {
+	pages := args.search.Pages(limit)
+	for pages.Next() {
+		var page []sproket.Doc
+		for _, doc := range pages.Docs() {
+			if args.search.Federate {
+				if emitted[doc.InstanceID] {
+					continue
+				}
+				emitted[doc.InstanceID] = true
+			}
+			if !(args.filter.allowed(doc)) {
+				filtered++
+				continue
+			}
+			if args.watch && args.manifest.known(doc) {
+				args.completeness.expect(doc)
+				args.completeness.present(doc)
+				known++
+				continue
+			}
 			if !(args.softDataNode) {
-				docChan <- doc
+				emit(newTask([]sproket.Doc{doc}))
 			} else {
-				allDocs[doc.InstanceID] = make(map[string]sproket.Doc)
-				allDocs[doc.InstanceID][doc.DataNode] = doc
+				page = append(page, doc)
 			}
 		}
-		if remaining == 0 {
-			break
+
+		// Find replica options if desired, and choose a data node for each file
+		found := replicas.find(page)
+		for _, doc := range page {
+			dataNodeMap := map[string]sproket.Doc{doc.DataNode: doc}
+			for _, replica := range found[doc.InstanceID] {
+				dataNodeMap[replica.DataNode] = replica
+			}
+			chooseDocs(args, dataNodeMap, emit, &counts)
+		}
+	}
+	if filtered != 0 && !(args.urlsOnly) {
+		fmt.Printf("%d files excluded by filename filters\n", filtered)
+	}
+	if known != 0 && !(args.urlsOnly) {
+		fmt.Printf("%d files already downloaded\n", known)
+	}
+	if args.softDataNode && args.verbose {
+		fmt.Printf("%d downloads submitted total\n", counts.submitted)
+		fmt.Printf("%d preferred downloads submitted\n", counts.preferred)
+		if args.filterDataNodes {
+			fmt.Printf("%d downloads rerouted to replicas by data node filters\n", counts.rerouted)
+			fmt.Printf("%d files dropped by data node filters\n", counts.dropped)
 		}
 	}
+}
+
+// choiceCounts tallies how files were assigned to data nodes
+type choiceCounts struct {
+	submitted int
+	preferred int
+	rerouted  int
+	dropped   int
+}
 
-	// Find replica options if desired
-	if args.softDataNode {
-		// Build list of potential alternative data nodes
-		var validDataOptions []string
-		for dataNodeMatch := range dataNodeMatches {
-			validDataOptions = append(validDataOptions, dataNodeMatch)
+// chooseDocs emits the task for a single file, leaving out documents served by data nodes that may not be used
+func chooseDocs(args *config, dataNodeMap map[string]sproket.Doc, emit func(t *task), counts *choiceCounts) {
+	lostOriginal := false
+	for dataNode, doc := range dataNodeMap {
+		if !(allowedDataNode(args, dataNode)) {
+			delete(dataNodeMap, dataNode)
+			lostOriginal = lostOriginal || !(doc.Replica)
 		}
-		// Restrict to this candidate data node only
-		args.search.Fields["data_node"] = strings.Join(validDataOptions, " OR ")
-		// These data nodes are replicas
-		args.search.Fields["replica"] = "true"
-		if args.verbose {
-			fmt.Println(args.search)
+	}
+	if len(dataNodeMap) == 0 {
+		counts.dropped++
+		return
+	} else if lostOriginal {
+		counts.rerouted++
+	}
+
+	docs, foundPreffered := orderDocs(args, dataNodeMap)
+	emit(newTask(docs))
+	counts.submitted++
+	if foundPreffered {
+		counts.preferred++
+	}
+}
+
+// orderDocs orders the documents of a single file from most to least preferred data node and reports whether a preferred data node serves it
+func orderDocs(args *config, dataNodeMap map[string]sproket.Doc) ([]sproket.Doc, bool) {
+	var docs []sproket.Doc
+	used := make(map[string]bool)
+	for _, prefferedDataNode := range args.search.DataNodePriority {
+		if doc, in := dataNodeMap[prefferedDataNode]; in && !(used[prefferedDataNode]) {
+			docs = append(docs, doc)
+			used[prefferedDataNode] = true
 		}
+	}
 
-		// Find candidate docs and verify if the version is the true latest version using the instance_id key
-		for cur := 0; ; cur += limit {
-			docs, remaining := args.search.SearchURLs(cur, limit)
-			for _, doc := range docs {
-				_, in := allDocs[doc.InstanceID]
-				if in {
-					allDocs[doc.InstanceID][doc.DataNode] = doc
-				}
-			}
-			if remaining == 0 {
-				break
+	// The original comes next, then any other replicas
+	var others []sproket.Doc
+	for dataNode, doc := range dataNodeMap {
+		if !(used[dataNode]) {
+			others = append(others, doc)
+		}
+	}
+	sort.Slice(others, func(i, j int) bool {
+		if others[i].Replica != others[j].Replica {
+			return !(others[i].Replica)
+		}
+		return others[i].DataNode < others[j].DataNode
+	})
+	return append(docs, others...), len(used) != 0
+}
+
+func rankDataNodes(args *config) {
+
+	// Find every data node able to serve part of the result set
+	args.search.Fields["replica"] = "*"
+	dataNodes := facet(args, "data_node")
+
+	// Grab a sample file from each data node to probe with
+	samples := make(map[string]string)
+	for dataNode := range dataNodes {
+		args.search.Fields["data_node"] = dataNode
+		docs, _ := args.search.SearchURLs(0, 1)
+		if len(docs) == 1 && docs[0].HTTPURL != "" {
+			samples[dataNode] = docs[0].HTTPURL
+		}
+	}
+	args.search.Fields["data_node"] = "*"
+	args.search.Fields["replica"] = "false"
+
+	var ranking []string
+	available := make(map[string]bool)
+	for _, result := range args.search.Client.RankDataNodes(samples) {
+		if args.verbose {
+			if result.Available {
+				fmt.Printf("probe %s: latency %s, throughput %.0f B/s\n", result.DataNode, result.Latency, result.Throughput)
+			} else {
+				fmt.Printf("probe %s: unavailable: %s\n", result.DataNode, result.Err)
 			}
 		}
+		if result.Available {
+			ranking = append(ranking, result.DataNode)
+			available[result.DataNode] = true
+		}
+	}
 
-		jobsSubmitted := 0
-		prefJobsSubmitted := 0
-		for _, dataNodeMap := range allDocs {
-			foundPreffered := false
-			for _, prefferedDataNode := range args.search.DataNodePriority {
-				for dataNode, doc := range dataNodeMap {
-					if prefferedDataNode == dataNode {
-						docChan <- doc
-						foundPreffered = true
-						jobsSubmitted++
-						prefJobsSubmitted++
-						break
-					}
-				}
-				if foundPreffered {
-					break
-				}
+	// Configured data nodes keep precedence when merging, ranked data nodes follow
+	if args.probeMerge {
+		var merged []string
+		configured := make(map[string]bool)
+		for _, dataNode := range args.search.DataNodePriority {
+			if available[dataNode] {
+				merged = append(merged, dataNode)
+				configured[dataNode] = true
 			}
-			if !(foundPreffered) {
-				for _, doc := range dataNodeMap {
-					docChan <- doc
-					jobsSubmitted++
-					break
-				}
+		}
+		for _, dataNode := range ranking {
+			if !(configured[dataNode]) {
+				merged = append(merged, dataNode)
 			}
 		}
-		if args.verbose {
-			fmt.Printf("%d downloads submitted total\n", jobsSubmitted)
-			fmt.Printf("%d preferred downloads submitted\n", prefJobsSubmitted)
+		ranking = merged
+	}
+	if args.verbose {
+		fmt.Println("data node ranking:")
+		fmt.Println(ranking)
+	}
+	args.search.DataNodePriority = ranking
+	args.softDataNode = (len(ranking) != 0)
+}
+
+func outputDatasets(args *config) {
+
+	// Ensure each dataset is only listed once
+	args.search.Fields["replica"] = "false"
+	if args.verbose {
+		fmt.Println(args.search)
+	}
+	var datasets []sproket.Dataset
+	limit := 250
+	for cur := 0; ; cur += limit {
+		page, remaining := args.search.SearchDatasets(cur, limit)
+		datasets = append(datasets, page...)
+		if remaining == 0 || len(page) == 0 {
+			break
 		}
 	}
-	close(docChan)
-	waiter.Wait()
+	if len(datasets) == 0 {
+		fmt.Println("no datasets match search criteria")
+		return
+	}
+	sort.Slice(datasets, func(i, j int) bool {
+		return datasets[i].InstanceID < datasets[j].InstanceID
+	})
+
+	// Output info
+	files := 0
+	var size int64
+	for _, dataset := range datasets {
+		fmt.Printf("%s\t%d files\t%d bytes\n", dataset.InstanceID, dataset.Files, dataset.Size)
+		files += dataset.Files
+		size += dataset.Size
+	}
+	fmt.Printf("%d datasets, %d files, %d bytes\n", len(datasets), files, size)
 }
 
 func outputFields(args *config) {
@@ -342,7 +1395,13 @@ func outputFields(args *config) {
 		fmt.Println(args.search)
 	}
 	// Grab sample fields from a single search result
-	keys := args.search.GetFields()
+	ctx, cancel := searchContext(args)
+	defer cancel()
+	keys, err := args.search.GetFieldsContext(ctx)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 	if keys == nil {
 		fmt.Println("no records match the search criteria, unable to determine fields")
 		return
@@ -360,26 +1419,42 @@ func outputDataNodes(args *config) {
 	if args.verbose {
 		fmt.Println(args.search)
 	}
-	_, n := args.search.SearchURLs(0, 0)
+	// The count and the data nodes with and without replication are independent, so they are searched for at once
+	var n int
+	var originals, all map[string]int
+	originalSearch := args.search.WithFields(map[string]string{"replica": "false"})
+	allSearch := args.search.WithFields(map[string]string{"replica": "*"})
+	waiter := sync.WaitGroup{}
+	waiter.Add(3)
+	go func() {
+		defer waiter.Done()
+		_, n = args.search.SearchURLs(0, 0)
+	}()
+	go func() {
+		defer waiter.Done()
+		originals = facetOf(args, originalSearch, "data_node")
+	}()
+	go func() {
+		defer waiter.Done()
+		all = facetOf(args, allSearch, "data_node")
+	}()
+	waiter.Wait()
 	if n == 0 {
 		fmt.Println("no records match search criteria")
 		return
 	}
 
-	var dataNodeOutput []string
-
 	// Ensure only unique files are output
-	args.search.Fields["replica"] = "false"
-	dataNodes := args.search.Facet("data_node")
+	var dataNodeOutput []string
 	fmt.Println("excluding replication:")
 	if args.verbose {
-		fmt.Println(args.search)
+		fmt.Println(*originalSearch)
 	}
-	if len(dataNodes) == 0 {
+	if len(originals) == 0 {
 		fmt.Println("an original data node is required for download from any data nodes and no original data node was found")
 		return
 	}
-	for dataNode := range dataNodes {
+	for dataNode := range originals {
 		dataNodeOutput = append(dataNodeOutput, dataNode)
 	}
 	sort.Strings(dataNodeOutput)
@@ -389,26 +1464,81 @@ func outputDataNodes(args *config) {
 	}
 	fmt.Println()
 
-	// Ensure all files are counted
-	args.search.Fields["replica"] = "*"
-
 	// Get data node counts and total count
-	dataNodes = args.search.Facet("data_node")
 	dataNodeOutput = nil
-	for dataNode := range dataNodes {
+	for dataNode := range all {
 		dataNodeOutput = append(dataNodeOutput, dataNode)
 	}
 	sort.Strings(dataNodeOutput)
 	// Output info
 	fmt.Println("including replication:")
 	if args.verbose {
-		fmt.Println(args.search)
+		fmt.Println(*allSearch)
 	}
 	for _, dataNode := range dataNodeOutput {
 		fmt.Println(dataNode)
 	}
 }
 
+// blockedField explains why a field may not be used with -values.for and what to try instead
+type blockedField struct {
+	reason      string
+	alternative string
+}
+
+var (
+	uniqueField     = blockedField{"its values are unique to each file or dataset, so every match would be listed", "use -count to size the result set, or -field.keys to find a coarser field"}
+	bookkeeping     = blockedField{"it is index bookkeeping that changes with every publication", ""}
+	continuousField = blockedField{"it holds continuous values that are nearly unique to each file", ""}
+	spatialField    = blockedField{"it holds continuous values that are nearly unique to each file", "try -values.for nominal_resolution instead"}
+	temporalField   = blockedField{"it holds continuous values that are nearly unique to each file", "try -values.for frequency instead"}
+)
+
+// defaultValuesForBlacklist holds the fields that are not useful to list values for
+var defaultValuesForBlacklist = map[string]blockedField{
+	"_timestamp":             bookkeeping,
+	"timestamp":              bookkeeping,
+	"_version_":              bookkeeping,
+	"id":                     uniqueField,
+	"dataset_id":             uniqueField,
+	"master_id":              uniqueField,
+	"instance_id":            uniqueField,
+	"citation_url":           uniqueField,
+	"pid":                    uniqueField,
+	"url":                    blockedField{uniqueField.reason, "use -urls.only to list the download URLs"},
+	"title":                  uniqueField,
+	"xlink":                  uniqueField,
+	"version":                blockedField{"every dataset carries its own version, so the values are as numerous as the datasets", "narrow the search to a single dataset before listing versions"},
+	"data_specs_version":     blockedField{"it only describes the metadata conventions the files were published with", "try -values.for mip_era instead"},
+	"datetime_start":         temporalField,
+	"datetime_stop":          temporalField,
+	"east_degrees":           spatialField,
+	"west_degrees":           spatialField,
+	"north_degrees":          spatialField,
+	"south_degrees":          spatialField,
+	"geo":                    spatialField,
+	"height_bottom":          continuousField,
+	"height_top":             continuousField,
+	"number_of_aggregations": continuousField,
+	"number_of_files":        continuousField,
+	"size":                   blockedField{continuousField.reason, "use -count to size the result set"},
+}
+
+// valuesForBlacklist applies the config file allow and block lists to the default blacklist
+func valuesForBlacklist(args *config) map[string]blockedField {
+	blacklist := make(map[string]blockedField)
+	for field, blocked := range defaultValuesForBlacklist {
+		blacklist[field] = blocked
+	}
+	for _, field := range args.search.ValuesForBlock {
+		blacklist[field] = blockedField{"it is blocked by \"values_for_block\" in the config file", ""}
+	}
+	for _, field := range args.search.ValuesForAllow {
+		delete(blacklist, field)
+	}
+	return blacklist
+}
+
 func outputValuesFor(args *config) {
 	blacklistSubstrings := []string{"*"}
 	for _, substring := range blacklistSubstrings {
@@ -417,12 +1547,18 @@ func outputValuesFor(args *config) {
 			return
 		}
 	}
-	blacklist := []string{"_timestamp", "timestamp", "id", "dataset_id", "master_id", "version", "citation_url", "data_specs_version", "datetime_start", "datetime_stop", "east_degrees", "west_degrees", "north_degrees", "geo", "height_bottom", "height_top", "instance_id", "number_of_aggregations", "number_of_files", "pid", "size", "south_degrees", "url", "title", "xlink", "_version_"}
-	for _, field := range blacklist {
-		if field == args.valuesFor {
-			fmt.Printf("'%s' is not an allowed field to search for values for\n", args.valuesFor)
-			return
+	blacklist := valuesForBlacklist(args)
+	if blocked, in := blacklist[args.valuesFor]; in {
+		fmt.Printf("'%s' is not an allowed field to search for values for: %s\n", args.valuesFor, blocked.reason)
+		if blocked.alternative != "" {
+			fmt.Println(blocked.alternative)
 		}
+		if _, byDefault := defaultValuesForBlacklist[args.valuesFor]; byDefault {
+			fmt.Printf("add \"%s\" to \"values_for_allow\" in the config file to list its values anyway\n", args.valuesFor)
+		} else {
+			fmt.Printf("remove \"%s\" from \"values_for_block\" in the config file to list its values\n", args.valuesFor)
+		}
+		return
 	}
 	// Ensure only unique files are output
 	args.search.Fields["replica"] = "false"
@@ -436,7 +1572,7 @@ func outputValuesFor(args *config) {
 	}
 
 	var values []string
-	valueCounts := args.search.Facet(args.valuesFor)
+	valueCounts := facet(args, args.valuesFor)
 	if len(valueCounts) == 0 {
 		fmt.Printf("no values could be found for the provided field: '%s'\n", args.valuesFor)
 		return
@@ -453,45 +1589,139 @@ func outputValuesFor(args *config) {
 
 func main() {
 
+	// Subcommands have their own flags
+	if len(os.Args) > 1 && os.Args[1] == "cite" {
+		cite(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "fetch" {
+		fetch(os.Args[2:])
+		return
+	}
+
 	var args config
-	flag.StringVar(&args.conf, "config", "", "Path to config file")
-	flag.StringVar(&args.outDir, "out.dir", ".", "Path to directory to put downloads in")
+	flag.StringVar(&args.conf, "config", "", "Path to config file, or - to read it from stdin")
+	flag.StringVar(&args.outDir, "out.dir", ".", "Path to directory to put downloads in, or an s3://bucket/prefix URL to stream them to an object store")
 	flag.StringVar(&args.valuesFor, "values.for", "", "Display the available values for a given field, within the result set of the provided search criteria")
 	flag.IntVar(&args.parallel, "p", 4, "Max number of concurrent downloads")
+	flag.IntVar(&args.verifyParallel, "verify.p", runtime.NumCPU(), "Max number of files hashed at once for verification, away from the downloads. 0 hashes within the downloads")
+	flag.IntVar(&args.hostParallel, "p.host", 0, "Max number of concurrent downloads from any single data node, 0 for no limit beyond -p")
 	flag.BoolVar(&args.noDownload, "no.download", false, "Flag to indicate no downloads should be performed")
 	flag.BoolVar(&args.verbose, "verbose", false, "Flag to indicate output should be verbose")
-	flag.BoolVar(&args.confirm, "y", false, "Flag to confirm larger downloads")
+	flag.BoolVar(&args.confirm, "y", false, "Flag to confirm larger downloads, and files over -large.size")
 	flag.BoolVar(&args.noVerify, "no.verify", false, "Flag to skip checksum verification")
 	flag.BoolVar(&args.fieldKeys, "field.keys", false, "Flag to output possible field keys. The outputted list may be incomplete for complicated reasons.")
+	flag.StringVar(&args.facets, "facets", "", "Comma separated fields to output the values of as JSON, with the number of files and, for up to 10000 files, the total size of each value")
 	flag.BoolVar(&args.displayDataNodes, "data.nodes", false, "Flag to output data nodes that serve the files that match the criteria")
+	flag.BoolVar(&args.datasets, "datasets", false, "Flag to output the datasets that contain the files matching the criteria, with their file counts and sizes")
+	flag.StringVar(&args.largeSize, "large.size", "100GB", "Files larger than this, like 100GB, are handled per -large.action. Empty for no limit")
+	flag.StringVar(&args.largeAction, "large.action", largeConfirm, "What to do with files larger than -large.size: confirm asks before downloading them unless -y is given or there is no terminal to ask, defer writes them to the -large.queue job file and skip leaves them out")
+	flag.StringVar(&args.maxBytes, "max.bytes", "", "Total size, like 500GB, of the files to queue for download. Files beyond it are deferred and reported. Empty for no limit")
+	flag.StringVar(&args.maxQueue, "max.queue", "", "Path to the job file that files deferred by -max.bytes are added to, run it later with -job")
+	flag.StringVar(&args.largeQueue, "large.queue", "", "Path to the job file that deferred large files are added to, run it later with -job")
+	flag.IntVar(&args.limit, "limit", 0, "Only download this many of the matching files, in instance_id order after -offset")
+	flag.IntVar(&args.offset, "offset", 0, "Skip this many of the matching files, in instance_id order")
+	flag.StringVar(&args.order, "order", "", "Order to download the files in once they are all resolved: size-asc for smallest first, size-desc for largest first, or name for instance_id order")
+	flag.IntVar(&args.sample, "sample", 0, "Only download a random sample of this many of the matching files, after -offset")
+	flag.Int64Var(&args.seed, "seed", 0, "Seed for -sample, to draw the same sample again. 0 picks a seed and reports it")
+	flag.Var(&args.include, "include", "Only download files whose filename matches this glob, or /regex/. May be repeated to allow several patterns")
+	flag.Var(&args.exclude, "exclude", "Never download files whose filename matches this glob, or /regex/. May be repeated")
+	flag.StringVar(&args.query, "q", "", "Free text query, as typed into the ESGF web portal, ANDed with the fields. Overrides query in the config file")
+	flag.StringVar(&args.start, "start", "", "Only files with data after this time, like 1980 or 1980-06-01. Overrides start in the config file")
+	flag.StringVar(&args.end, "end", "", "Only files with data before this time, like 2010 or 2010-12-31. Overrides end in the config file")
+	flag.StringVar(&args.bbox, "bbox", "", "Only files with data within this west,south,east,north box in degrees. Overrides bbox in the config file")
+	flag.StringVar(&args.dataVersion, "data.version", "", "Dataset version to download, like 20190818, or all for every version. Overrides version in the config file and lifts the latest and retracted requirements")
+	flag.StringVar(&args.datasetIDs, "dataset.ids", "", "Comma separated dataset instance_ids, as output by -datasets, to restrict the files to")
 	flag.BoolVar(&args.count, "count", false, "Flag to only count number of files that would be attempted to be downloaded")
 	flag.BoolVar(&args.version, "version", false, "Flag to output the version and exit")
-	flag.BoolVar(&args.urlsOnly, "urls.only", false, "Flag to only output to stdout the HTTP URLs that would be used")
+	flag.BoolVar(&args.urlsOnly, "urls.only", false, "Flag to only output to stdout the URLs that would be used, of the most preferred -protocols")
 	flag.BoolVar(&args.unsafe, "unsafe", false, "Removes the hard set requirement of the retracted field being false and latest being true. The user is then free to specify these fields themselves in the search config, but are not required to.")
+	flag.StringVar(&args.excludeDataNodes, "data.node.exclude", "", "Comma separated data nodes that files must never be downloaded from, in addition to data_node_exclude")
+	flag.StringVar(&args.onlyDataNodes, "data.node.only", "", "Comma separated data nodes that files may only be downloaded from, in addition to data_node_only")
+	flag.IntVar(&args.shardDepth, "shard.depth", 0, "Number of levels of hashed subdirectories, named by two hex characters of the checksum, to spread downloads across. Implies a manifest in the output directory if -manifest is not specified")
+	flag.StringVar(&args.jobPath, "job", "", "Path to a job file recording the resolved files and their status. Rerunning with the same job file resumes it without searching again")
+	flag.BoolVar(&args.plan, "plan", false, "Flag to output what would happen to each file, its size, data node and whether it would be skipped, downloaded, failed over or fail, without downloading anything")
+	flag.StringVar(&args.planOut, "plan.out", "", "Path to write the -plan as JSON to instead, which can later be run as a -job or compared against with -plan.compare")
+	flag.StringVar(&args.planCompare, "plan.compare", "", "Path to an earlier plan or job file to compare the files this search would now download against, without downloading anything")
+	flag.BoolVar(&args.interactive, "interactive", false, "Flag to browse the values of -interactive.fields with live file counts and sizes, select values and download the selection")
+	flag.StringVar(&args.interactiveFields, "interactive.fields", "project,experiment_id,variable_id", "Comma separated fields to drill into with -interactive, in order")
+	flag.BoolVar(&args.watch, "watch", false, "Flag to keep running, searching again every -interval and downloading only files not already in the manifest. Implies -y, and -large.action skip unless defer is specified, as confirm can not be answered")
+	flag.DurationVar(&args.interval, "interval", 6*time.Hour, "Time between the searches of -watch, like 6h")
+	flag.StringVar(&args.stageDir, "stage.dir", "", "Path to a directory to write partial downloads in, they are moved into the output directory once verified")
+	flag.StringVar(&args.protocolList, "protocols", "", "Comma separated access methods, HTTPServer or GridFTP, to download through in order of preference, falling back to the next on the same data node before failing over. Overrides protocols in the config file, default HTTPServer")
+	flag.BoolVar(&args.requireComplete, "require.complete", false, "Flag to keep verified files under .held names until every file queued from their dataset has verified, so only complete datasets appear in the output directory")
+	flag.BoolVar(&args.noFsync, "no.fsync", false, "Flag to skip flushing downloads to disk before they are renamed to their final names")
+	flag.DurationVar(&args.partialsAge, "partials.age", 0, "Remove partial downloads not written to for this long, like 168h, from the staging or output directory before downloading. 0 keeps them all")
+	flag.StringVar(&args.cacheDir, "cache.dir", "", "Path to a directory to keep the results of count and facet searches in, so repeated runs within -cache.ttl reuse them")
+	flag.DurationVar(&args.cacheTTL, "cache.ttl", time.Hour, "How long results kept in -cache.dir are reused for")
+	flag.BoolVar(&args.audit, "audit", false, "Flag to check every file in the manifest, or else the output directory, against the index and report those retracted, superseded by a newer version or gone from the index")
+	flag.StringVar(&args.auditOut, "audit.out", "", "Path to write the -audit report to as JSON")
+	flag.StringVar(&args.linkMode, "link", "", "Link type, hard or sym, to place files already downloaded into a -link.from directory by linking to them instead of downloading them again")
+	flag.StringVar(&args.linkFrom, "link.from", "", "Comma separated output directories of earlier downloads to link to, their files are found by their manifest, checksum list or instance_id")
+	flag.StringVar(&args.sumsType, "sums", "", "Checksum type, sha256 or md5, to keep a sha256sums.txt or md5sums.txt of the verified files in the output directory, for use with sha256sum -c or md5sum -c")
+	flag.StringVar(&args.manifestPath, "manifest", "", "Path to a JSON manifest mapping each downloaded instance_id to its path within the output directory, updated across runs")
+	flag.IntVar(&args.chunks, "chunks", 1, fmt.Sprintf("Number of concurrent ranged connections to split each large file across, when the data node supports it, at most %d", sproket.MaxSegments))
+	flag.StringVar(&args.window, "window", "", "Daily window to download in, like 22:00-06:00. Transfers stop when the window closes and resume where they left off when it opens again")
+	flag.DurationVar(&args.searchTimeout, "search.timeout", 2*time.Minute, "Time to allow a facet or field search, including retries, before giving up, 0 for no limit")
+	flag.IntVar(&args.retries, "search.retries", 2, "Number of times to retry a failed search request")
+	flag.Float64Var(&args.searchRate, "search.rate", 5, "Max number of search requests per second to each search API, 0 for no limit. Searches are also held back for as long as an overloaded search API asks")
+	flag.DurationVar(&args.searchBackoff, "search.backoff", 2*time.Second, "Delay before retrying a failed search request, doubled for each further retry")
+	flag.DurationVar(&args.connectTimeout, "connect.timeout", 0, "Time to allow for connecting to a server, including the TLS handshake. Overrides connect_timeout in the config file, default 30s")
+	flag.DurationVar(&args.readTimeout, "read.timeout", 0, "Time to wait for a response or more data before abandoning a stalled request. Overrides read_timeout in the config file, default no limit")
+	flag.StringVar(&args.proxy, "proxy", "", "URL of the proxy to use for every request. Overrides proxy in the config file and the HTTP_PROXY and HTTPS_PROXY environment variables")
+	flag.StringVar(&args.hookExec, "hook.exec", "", "Command to run, through the shell, for every file downloaded and verified. SPROKET_PATH, SPROKET_INSTANCE_ID and other SPROKET_ environment variables describe the file")
+	flag.StringVar(&args.hookFacets, "hook.facets", "", "Comma separated fields to pass to -hook.exec as SPROKET_FACET_ environment variables, in addition to the search fields")
+	flag.StringVar(&args.notifyURL, "notify.url", "", "URL to post a JSON summary of the run to once it completes")
+	flag.StringVar(&args.notifyEmail, "notify.email", "", "Email address to send a summary of the run to once it completes")
+	flag.StringVar(&args.notifySMTP, "notify.smtp", "localhost:25", "SMTP server to send -notify.email through")
+	flag.BoolVar(&args.noHTTP2, "no.http2", false, "Flag to only use HTTP/1.1, never HTTP/2")
+	flag.DurationVar(&args.tlsReload, "tls.reload", time.Hour, "How often to check ca_bundle, client_cert and client_key for renewed certificates")
+	flag.BoolVar(&args.failover, "failover", false, "Flag to find replicas on every data node so a failed download can fail over to another data node, not just those in data_node_priority")
+	flag.BoolVar(&args.probe, "probe", false, "Flag to probe candidate data nodes and prefer them by availability and throughput, replacing data_node_priority")
+	flag.BoolVar(&args.probeMerge, "probe.merge", false, "Flag to keep data_node_priority ahead of the probed ranking when -probe is specified")
 	flag.Parse()
 	if args.version {
 		fmt.Println(VERSION)
 		return
 	}
+	mode, err := resolveMode(setFlags())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 	// Everything beyond this point requires an initialized Search object
 	if args.conf == "" {
 		fmt.Println("-config is required, use -h for help")
 		return
 	}
-	err := args.Init()
+	err = args.Init()
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	if args.displayDataNodes {
+	switch mode {
+	case modeInteractive:
+		interactive(&args)
+	case modeAudit:
+		audit(&args)
+	case modeDatasets:
+		outputDatasets(&args)
+	case modeFacets:
+		outputFacets(&args)
+	case modeDataNodes:
 		outputDataNodes(&args)
-	} else if args.valuesFor != "" {
+	case modeValuesFor:
 		outputValuesFor(&args)
-	} else if args.fieldKeys {
+	case modeFieldKeys:
 		outputFields(&args)
-	} else if len(args.search.Fields) > 0 {
-		getBySearch(&args)
-	} else {
-		flag.Usage()
+	default:
+		// Downloads need search criteria
+		if len(args.search.Fields) == 0 {
+			flag.Usage()
+		} else if mode == modeWatch {
+			watch(&args)
+		} else {
+			getBySearch(&args)
+		}
 	}
 }
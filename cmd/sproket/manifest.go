@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sproket"
+	"strings"
+	"sync"
+	"time"
+)
+
+// manifestSaveInterval is the minimum time between intermediate saves of the manifest during a run
+const manifestSaveInterval = time.Minute
+
+// manifestEntry maps a file's logical name, its instance_id, to where it was placed in the output directory
+type manifestEntry struct {
+	InstanceID   string    `json:"instance_id"`
+	Path         string    `json:"path"`
+	DataNode     string    `json:"data_node"`
+	Checksum     string    `json:"checksum"`
+	ChecksumType string    `json:"checksum_type"`
+	DatasetID    string    `json:"dataset_id"`
+	Version      string    `json:"version"`
+	PID          []string  `json:"pid,omitempty"`
+	Citation     []string  `json:"citation_url,omitempty"`
+	Time         time.Time `json:"time"`
+}
+
+// manifest records every file placed in the output directory, it is kept up to date across runs
+type manifest struct {
+	SearchAPI string                   `json:"search_api"`
+	Updated   time.Time                `json:"updated"`
+	Files     map[string]manifestEntry `json:"files"`
+	path      string
+	outDir    string
+	lastSave  time.Time
+	mutex     sync.Mutex
+}
+
+// loadManifest reads the manifest at path, or starts a new one if none exists yet
+func loadManifest(path string, outDir string) (*manifest, error) {
+	m := manifest{
+		Files:    make(map[string]manifestEntry),
+		path:     path,
+		outDir:   outDir,
+		lastSave: time.Now(),
+	}
+	fileBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(fileBytes, &m); err != nil {
+		return nil, fmt.Errorf("%s is not a valid manifest: %s", path, err)
+	}
+	if m.Files == nil {
+		m.Files = make(map[string]manifestEntry)
+	}
+	return &m, nil
+}
+
+// record adds a file placed at dest to the manifest
+func (m *manifest) record(doc sproket.Doc, dest string) {
+	rel, err := filepath.Rel(m.outDir, dest)
+	if isObjectStore(m.outDir) {
+		rel, err = strings.TrimPrefix(dest, strings.TrimSuffix(m.outDir, "/")+"/"), nil
+	}
+	if err != nil {
+		rel = dest
+	}
+	m.mutex.Lock()
+	// Files found already present keep the time they were first recorded, their download time
+	recorded := time.Now().UTC()
+	if previous, in := m.Files[doc.InstanceID]; in && previous.Checksum == doc.GetSum() && !(previous.Time.IsZero()) {
+		recorded = previous.Time
+	}
+	m.Files[doc.InstanceID] = manifestEntry{
+		InstanceID:   doc.InstanceID,
+		Path:         filepath.ToSlash(rel),
+		DataNode:     doc.DataNode,
+		Checksum:     doc.GetSum(),
+		ChecksumType: doc.GetSumType(),
+		DatasetID:    doc.GetDatasetInstanceID(),
+		Version:      doc.GetDatasetVersion(),
+		PID:          doc.PID,
+		Citation:     doc.Citation,
+		Time:         recorded,
+	}
+	due := time.Since(m.lastSave) > manifestSaveInterval
+	m.mutex.Unlock()
+
+	// Save periodically so a crash does not lose the record of a long run
+	if due {
+		if err := m.save(); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// known reports whether the file of doc is already in the manifest with the same checksum, and still present
+func (m *manifest) known(doc sproket.Doc) bool {
+	m.mutex.Lock()
+	entry, in := m.Files[doc.InstanceID]
+	m.mutex.Unlock()
+	if !(in) || entry.Checksum != doc.GetSum() {
+		return false
+	}
+	if isObjectStore(m.outDir) {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(m.outDir, filepath.FromSlash(entry.Path)))
+	return err == nil
+}
+
+// size returns the number of files in the manifest
+func (m *manifest) size() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.Files)
+}
+
+// save writes the manifest, replacing the previous copy only once it is completely written
+func (m *manifest) save() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Updated = time.Now().UTC()
+	m.lastSave = time.Now()
+	fileBytes, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.tmp", m.path)
+	if err := ioutil.WriteFile(tmp, fileBytes, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path)
+}
+
+// destPath returns where the file for doc is placed in the output directory
+func destPath(args *config, doc sproket.Doc) string {
+	return filepath.Join(args.outDir, filepath.FromSlash(relPath(args, doc)))
+}
+
+// relPath returns the slash separated path of the file for doc within the output, named per fileName and sharded
+// into hashed subdirectories if desired
+func relPath(args *config, doc sproket.Doc) string {
+	if args.shardDepth <= 0 {
+		return args.names.name("", doc.InstanceID)
+	}
+	key := strings.ToLower(doc.GetSum())
+	if len(key) < 2*args.shardDepth {
+		key = fmt.Sprintf("%x", sha256.Sum256([]byte(doc.InstanceID)))
+	}
+	var parts []string
+	for level := 0; level < args.shardDepth; level++ {
+		parts = append(parts, key[2*level:2*level+2])
+	}
+	parts = append(parts, args.names.name(strings.Join(parts, "/"), doc.InstanceID))
+	return strings.Join(parts, "/")
+}
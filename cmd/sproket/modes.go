@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// Modes sproket runs in, the flags choosing them can not be combined
+const (
+	modeDownload    = "download"
+	modeWatch       = "watch"
+	modeInteractive = "interactive"
+	modeAudit       = "audit"
+	modeDatasets    = "datasets"
+	modeFacets      = "facets"
+	modeDataNodes   = "data.nodes"
+	modeValuesFor   = "values.for"
+	modeFieldKeys   = "field.keys"
+)
+
+// modeFlags are the flags that choose a mode other than a single download, each is its own mode
+var modeFlags = []string{
+	modeWatch, modeInteractive, modeAudit, modeDatasets, modeFacets, modeDataNodes, modeValuesFor, modeFieldKeys,
+}
+
+// variantFlags change what a download does instead of downloading, at most one may be used. -plan.out
+// goes along with -plan
+var variantFlags = []string{"count", "urls.only", "no.download", "plan", "plan.compare"}
+
+// modeOptions are flags that only apply to a single mode
+var modeOptions = []struct {
+	name string
+	mode string
+}{
+	{"audit.out", modeAudit},
+	{"interactive.fields", modeInteractive},
+	{"interval", modeWatch},
+}
+
+// resolveMode returns the mode chosen by the flags that were set, or an error naming the flags that conflict
+func resolveMode(set map[string]bool) (string, error) {
+	if set["plan.out"] {
+		set["plan"] = true
+	}
+
+	var modes []string
+	for _, name := range modeFlags {
+		if set[name] {
+			modes = append(modes, name)
+		}
+	}
+	if len(modes) > 1 {
+		return "", fmt.Errorf("%s can not be combined, run them separately", flagList(modes))
+	}
+	mode := modeDownload
+	if len(modes) == 1 {
+		mode = modes[0]
+	}
+
+	var variants []string
+	for _, name := range variantFlags {
+		if set[name] {
+			variants = append(variants, name)
+		}
+	}
+	if len(variants) > 1 {
+		return "", fmt.Errorf("%s can not be combined, choose one", flagList(variants))
+	}
+
+	// Variants only apply to a single download run
+	if len(variants) == 1 && mode != modeDownload {
+		return "", fmt.Errorf("-%s only applies to downloads, it has no effect with -%s", variants[0], mode)
+	}
+	if set["y"] && len(variants) == 1 {
+		return "", fmt.Errorf("-y confirms downloads, but -%s downloads nothing, leave out -y", variants[0])
+	}
+	if set["y"] && mode != modeDownload && mode != modeWatch && mode != modeInteractive {
+		return "", fmt.Errorf("-y confirms downloads, but -%s downloads nothing, leave out -y", mode)
+	}
+
+	for _, option := range modeOptions {
+		if set[option.name] && mode != option.mode {
+			return "", fmt.Errorf("-%s only applies to -%s", option.name, option.mode)
+		}
+	}
+	return mode, nil
+}
+
+// setFlags returns the names of the flags set on the command line
+func setFlags() map[string]bool {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// flagList lists flag names for a message, like "-count and -urls.only"
+func flagList(names []string) string {
+	var flags []string
+	for _, name := range names {
+		flags = append(flags, fmt.Sprintf("-%s", name))
+	}
+	if len(flags) == 1 {
+		return flags[0]
+	}
+	return fmt.Sprintf("%s and %s", strings.Join(flags[:len(flags)-1], ", "), flags[len(flags)-1])
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// maxNameLength is the longest file name written, leaving room for the suffixes of partial downloads within the
+// 255 byte limit of common filesystems
+const maxNameLength = 255 - len(".part.chunks.tmp")
+
+// unsafeChars are the characters some filesystem does not allow in a file name, or that would leave the output
+// directory. % is included so encoded names can not be confused with instance_ids
+const unsafeChars = `<>:"/\|?*%`
+
+// reservedNames are the device names Windows will not create files with, whatever their extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// fileName returns the name the file with the instance_id is stored under, which is the instance_id unless it
+// can not be used as a file name everywhere. Unsafe characters are percent encoded, as are a trailing dot or
+// space and the first character of a reserved name, so distinct instance_ids keep distinct names. Names too long
+// are shortened, keeping a hash of the whole instance_id
+func fileName(instanceID string) string {
+	var b strings.Builder
+	for i := 0; i < len(instanceID); i++ {
+		c := instanceID[i]
+		last := i == len(instanceID)-1
+		if c < 0x20 || c == 0x7f || strings.IndexByte(unsafeChars, c) != -1 || (last && (c == '.' || c == ' ')) {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	name := b.String()
+	if stem := strings.SplitN(name, ".", 2)[0]; reservedNames[strings.ToUpper(stem)] {
+		name = fmt.Sprintf("%%%02X%s", name[0], name[1:])
+	}
+	if len(name) > maxNameLength {
+		name = hashedName(name, instanceID)
+	}
+	return name
+}
+
+// hashedName shortens name, keeping its extension, and adds a hash of the instance_id so it stays unique
+func hashedName(name string, instanceID string) string {
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte(instanceID)))[:16]
+	ext := path.Ext(name)
+	if len(ext) > 16 {
+		ext = ""
+	}
+	stem := strings.TrimSuffix(name, ext)
+	keep := maxNameLength - len(ext) - len(sum) - 1
+	if len(stem) > keep {
+		stem = stem[:keep]
+		// Do not split a multibyte character
+		for len(stem) != 0 && !(utf8.ValidString(stem)) {
+			stem = stem[:len(stem)-1]
+		}
+	}
+	return fmt.Sprintf("%s~%s%s", stem, sum, ext)
+}
+
+// instanceOf returns the instance_id of a file from its name, for names that were not shortened
+func instanceOf(name string) string {
+	instanceID, err := url.PathUnescape(name)
+	if err != nil {
+		return name
+	}
+	return instanceID
+}
+
+// namesFile is the file in the output directory recording the instance_ids given a hashed name to tell them apart
+const namesFile = "sproket_names.json"
+
+// names maps the instance_ids of a run to the names their files are stored under. Instance_ids differing only
+// by case get distinct names, so they do not overwrite each other on case-insensitive filesystems. A name is
+// only hashed if a file differing from it only by case is already in the output directory or named this run,
+// and hashed names are recorded in namesFile, so a file is found under the same name on every run
+type names struct {
+	outDir     string
+	byInstance map[string]string
+	byFolded   map[string]string
+	hashed     map[string]string
+	listed     map[string]map[string]string
+	changed    bool
+	mutex      sync.Mutex
+}
+
+// newNames returns the names of a run, starting from the hashed names recorded in the output directory and the
+// names in the manifest, if any. Names are only checked against the output directory when it is on local disk
+func newNames(outDir string, m *manifest) (*names, error) {
+	n := &names{
+		outDir:     outDir,
+		byInstance: make(map[string]string),
+		byFolded:   make(map[string]string),
+		hashed:     make(map[string]string),
+		listed:     make(map[string]map[string]string),
+	}
+	if outDir != "" {
+		fileBytes, err := ioutil.ReadFile(filepath.Join(outDir, namesFile))
+		if err == nil {
+			if err := json.Unmarshal(fileBytes, &n.hashed); err != nil {
+				return nil, fmt.Errorf("%s is not a valid names file: %s", filepath.Join(outDir, namesFile), err)
+			}
+		} else if !(os.IsNotExist(err)) {
+			return nil, err
+		}
+	}
+	if m == nil {
+		return n, nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for instanceID, entry := range m.Files {
+		if name := path.Base(entry.Path); name != fileName(instanceID) {
+			n.hashed[instanceID] = name
+		}
+	}
+	return n, nil
+}
+
+// name returns the name of the file with the instance_id, in the slash separated directory dir of the output
+func (n *names) name(dir string, instanceID string) string {
+	if n == nil {
+		return fileName(instanceID)
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if name, ok := n.byInstance[instanceID]; ok {
+		return name
+	}
+	name, hashed := n.hashed[instanceID]
+	if !(hashed) {
+		name = fileName(instanceID)
+		other, taken := n.byFolded[strings.ToLower(path.Join(dir, name))]
+		onDisk := n.onDisk(dir, name)
+		if (taken && other != instanceID) || (!(taken) && onDisk != "" && onDisk != name) {
+			name = hashedName(name, instanceID)
+			n.hashed[instanceID] = name
+			n.changed = true
+		}
+	}
+	n.byInstance[instanceID] = name
+	n.byFolded[strings.ToLower(path.Join(dir, name))] = instanceID
+	return name
+}
+
+// onDisk returns the name of the file, or partial or held download, in dir of the output directory that differs from
+// name at most by case, if there is one. Each directory is only listed once, the mutex must be held
+func (n *names) onDisk(dir string, name string) string {
+	if n.outDir == "" {
+		return ""
+	}
+	listing, ok := n.listed[dir]
+	if !(ok) {
+		listing = make(map[string]string)
+		entries, _ := ioutil.ReadDir(filepath.Join(n.outDir, filepath.FromSlash(dir)))
+		for _, entry := range entries {
+			existing := strings.TrimSuffix(strings.TrimSuffix(entry.Name(), ".part"), ".held")
+			listing[strings.ToLower(existing)] = existing
+		}
+		n.listed[dir] = listing
+	}
+	return listing[strings.ToLower(name)]
+}
+
+// save records the hashed names in the output directory, if any were added this run
+func (n *names) save() error {
+	if n == nil || n.outDir == "" {
+		return nil
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if !(n.changed) {
+		return nil
+	}
+	fileBytes, err := json.MarshalIndent(n.hashed, "", "    ")
+	if err != nil {
+		return err
+	}
+	dest := filepath.Join(n.outDir, namesFile)
+	tmp := fmt.Sprintf("%s.tmp", dest)
+	if err := ioutil.WriteFile(tmp, fileBytes, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		return err
+	}
+	n.changed = false
+	return nil
+}
+
+// instanceNames returns the instance_ids of the hashed names recorded in the output directory
+func instanceNames(outDir string) map[string]string {
+	byName := make(map[string]string)
+	hashed := make(map[string]string)
+	fileBytes, err := ioutil.ReadFile(filepath.Join(outDir, namesFile))
+	if err != nil || json.Unmarshal(fileBytes, &hashed) != nil {
+		return byName
+	}
+	for instanceID, name := range hashed {
+		byName[name] = instanceID
+	}
+	return byName
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+// absDirs does nothing, paths are not limited in length beyond their names
+func absDirs(args *config) error {
+	return nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import "path/filepath"
+
+// absDirs makes the output and staging directories absolute, as Go only lifts the 260 character limit of
+// Windows on absolute paths
+func absDirs(args *config) error {
+	var err error
+	if args.store == nil {
+		if args.outDir, err = filepath.Abs(args.outDir); err != nil {
+			return err
+		}
+	}
+	if args.stageDir != "" {
+		if args.stageDir, err = filepath.Abs(args.stageDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
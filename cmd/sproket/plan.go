@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sproket"
+	"time"
+)
+
+// Actions a plan expects to take for a file
+const (
+	actionSkip     = "skip"
+	actionDownload = "download"
+	actionFailover = "failover"
+	actionFail     = "fail"
+)
+
+// planEntry is the decision made for a single file. It extends a job task, so a plan can be run as a job
+// or compared against with -plan.compare
+type planEntry struct {
+	InstanceID string        `json:"instance_id"`
+	Action     string        `json:"action"`
+	Size       int64         `json:"size"`
+	DataNode   string        `json:"data_node"`
+	Fallbacks  []string      `json:"fallbacks"`
+	Present    bool          `json:"present"`
+	Verified   bool          `json:"verified"`
+	Docs       []sproket.Doc `json:"docs"`
+	Status     string        `json:"status"`
+}
+
+// plan is the complete set of decisions for a search, in the layout of a job file
+type plan struct {
+	Version  string      `json:"sproket_version"`
+	Created  time.Time   `json:"created"`
+	Resolved bool        `json:"resolved"`
+	Tasks    []planEntry `json:"tasks"`
+}
+
+// makePlan resolves the search and reports what a run would do with each file, without downloading anything
+func makePlan(args *config) {
+	var tasks []*task
+	resolve(args, func(t *task) {
+		tasks = append(tasks, t)
+	})
+	tasks = orderTasks(args, selectTasks(args, tasks))
+
+	// Data nodes that do not answer now would be failed over from
+	available := make(map[string]bool)
+	samples := make(map[string]string)
+	for _, t := range tasks {
+		for _, doc := range t.Docs {
+			if _, in := samples[doc.DataNode]; !(in) && doc.HTTPURL != "" {
+				samples[doc.DataNode] = doc.HTTPURL
+			}
+		}
+	}
+	for _, result := range args.search.Client.RankDataNodes(samples) {
+		available[result.DataNode] = result.Available
+		if !(result.Available) && args.verbose {
+			fmt.Printf("probe %s: unavailable: %s\n", result.DataNode, result.Err)
+		}
+	}
+
+	p := plan{Version: VERSION, Created: time.Now().UTC(), Resolved: true}
+	counts := make(map[string]int)
+	sizes := make(map[string]int64)
+	for _, t := range tasks {
+		entry := planTask(args, t, available)
+		p.Tasks = append(p.Tasks, entry)
+		counts[entry.Action]++
+		sizes[entry.Action] += entry.Size
+	}
+
+	if args.planOut != "" {
+		fileBytes, err := json.MarshalIndent(p, "", "    ")
+		if err == nil {
+			err = ioutil.WriteFile(args.planOut, fileBytes, 0644)
+		}
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	} else {
+		for _, entry := range p.Tasks {
+			fmt.Printf("%-8s  %-30s  %10s  %s", entry.Action, entry.DataNode, formatSize(entry.Size), entry.InstanceID)
+			if len(entry.Fallbacks) != 0 {
+				fmt.Printf("  (then %v)", entry.Fallbacks)
+			}
+			fmt.Println()
+		}
+	}
+	for _, action := range []string{actionDownload, actionFailover, actionSkip, actionFail} {
+		fmt.Printf("%d files to %s, %s\n", counts[action], action, formatSize(sizes[action]))
+	}
+}
+
+// planTask decides what a run would do with a single file
+func planTask(args *config, t *task, available map[string]bool) planEntry {
+	first := t.Docs[0]
+	entry := planEntry{
+		InstanceID: t.InstanceID,
+		Size:       first.Size,
+		Docs:       t.Docs,
+		Status:     statusPending,
+	}
+	entry.Present, entry.Verified = present(args, first)
+	if entry.Verified {
+		entry.Action = actionSkip
+		entry.DataNode = first.DataNode
+		entry.Status = statusDone
+		return entry
+	}
+
+	// The first available data node is used, later ones remain to fail over to
+	for i, doc := range t.Docs {
+		if !(available[doc.DataNode]) {
+			continue
+		}
+		entry.DataNode = doc.DataNode
+		entry.Action = actionDownload
+		if i != 0 {
+			entry.Action = actionFailover
+		}
+		for _, fallback := range t.Docs[i+1:] {
+			entry.Fallbacks = append(entry.Fallbacks, fallback.DataNode)
+		}
+		return entry
+	}
+	entry.Action = actionFail
+	entry.DataNode = first.DataNode
+	return entry
+}
+
+// present reports whether the file of doc is already in place, and whether it is verified
+func present(args *config, doc sproket.Doc) (bool, bool) {
+	if args.store != nil {
+		metadata, in, err := args.store.s3.Metadata(args.store.bucket, args.store.key(args, doc))
+		if err != nil || !(in) {
+			return false, false
+		}
+		return true, doc.GetSum() != "" && metadata["checksum"] == doc.GetSum()
+	}
+	dest := destPath(args, doc)
+	if _, err := os.Stat(dest); err != nil {
+		return false, false
+	}
+	return true, check(dest, doc.GetSum(), doc.GetSumType()) == nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sproket"
+	"strings"
+)
+
+// gridFTPClient is the external command GridFTP downloads are made with
+const gridFTPClient = "globus-url-copy"
+
+// protocols holds the access methods to download through in order of preference, optionally per data node
+type protocols struct {
+	preferred  []string
+	byDataNode map[string][]string
+}
+
+// newProtocols returns the preferences from -protocols, or else protocols in the config file, along with
+// data_node_protocols. Only methods that deliver the original file can be used
+func newProtocols(protocolList string, search *sproket.Search) (*protocols, error) {
+	p := &protocols{preferred: []string{sproket.ServiceHTTP}, byDataNode: make(map[string][]string)}
+	var err error
+	if protocolList != "" {
+		p.preferred, err = canonicalProtocols(splitList(protocolList))
+	} else if len(search.Protocols) != 0 {
+		p.preferred, err = canonicalProtocols(search.Protocols)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for dataNode, services := range search.DataNodeProtocols {
+		p.byDataNode[dataNode], err = canonicalProtocols(services)
+		if err != nil {
+			return nil, fmt.Errorf("data_node_protocols for %s: %s", dataNode, err)
+		}
+	}
+	if p.needs(sproket.ServiceGridFTP) {
+		if _, err := exec.LookPath(gridFTPClient); err != nil {
+			return nil, fmt.Errorf("%s downloads require %s on the PATH: %s", sproket.ServiceGridFTP, gridFTPClient, err)
+		}
+	}
+	return p, nil
+}
+
+// canonicalProtocols checks that each service can be downloaded through, spelling it as the index does
+func canonicalProtocols(services []string) ([]string, error) {
+	var result []string
+	for _, service := range services {
+		switch {
+		case strings.EqualFold(service, sproket.ServiceHTTP):
+			result = append(result, sproket.ServiceHTTP)
+		case strings.EqualFold(service, sproket.ServiceGridFTP):
+			result = append(result, sproket.ServiceGridFTP)
+		case strings.EqualFold(service, sproket.ServiceOPeNDAP):
+			return nil, fmt.Errorf("%s serves subsets of the data rather than the file, so it can not be checksum verified", service)
+		case strings.EqualFold(service, sproket.ServiceGlobus):
+			return nil, fmt.Errorf("%s URLs are for Globus transfers, which are run with the Globus CLI or web app", service)
+		default:
+			return nil, fmt.Errorf("unknown protocol %s, use %s or %s", service, sproket.ServiceHTTP, sproket.ServiceGridFTP)
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no protocols given")
+	}
+	return result, nil
+}
+
+// needs reports whether the service is preferred anywhere
+func (p *protocols) needs(service string) bool {
+	for _, s := range p.preferred {
+		if s == service {
+			return true
+		}
+	}
+	for _, services := range p.byDataNode {
+		for _, s := range services {
+			if s == service {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// access returns the URLs to try for the file, in order of preference for its data node. Without preferences
+// only HTTP is used
+func (p *protocols) access(doc sproket.Doc) []sproket.AccessURL {
+	if p == nil {
+		return doc.AccessFor([]string{sproket.ServiceHTTP})
+	}
+	services := p.preferred
+	if dataNodeServices, ok := p.byDataNode[doc.DataNode]; ok {
+		services = dataNodeServices
+	}
+	return doc.AccessFor(services)
+}
+
+// preferredURL returns the URL the file would be downloaded from first
+func preferredURL(args *config, doc sproket.Doc) string {
+	if accesses := args.protocols.access(doc); len(accesses) != 0 {
+		return accesses[0].URL
+	}
+	return doc.HTTPURL
+}
+
+// gridFTP downloads the file at url to dest with the GridFTP client
+func gridFTP(url string, dest string) error {
+	abs, err := filepath.Abs(dest)
+	if err != nil {
+		return err
+	}
+	// Windows drive paths need a leading slash in a file URL
+	path := filepath.ToSlash(abs)
+	if !(strings.HasPrefix(path, "/")) {
+		path = "/" + path
+	}
+	cmd := exec.Command(gridFTPClient, url, "file://"+path)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		os.Remove(dest)
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
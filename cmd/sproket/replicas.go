@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sproket"
+	"strings"
+)
+
+// replicaBatch is the number of datasets whose replicas are looked up in a single search
+const replicaBatch = 20
+
+// replicaLookup finds the replicas of the original files on the matching data nodes, a page of files at a time
+type replicaLookup struct {
+	search   sproket.Search
+	datasets map[string]map[string][]sproket.Doc
+}
+
+// newReplicaLookup prepares a search restricted to replicas on the matching data nodes
+func newReplicaLookup(args *config, dataNodeMatches map[string]bool) *replicaLookup {
+	// The search is copied, the originals are still being paged through with the shared one
+	search := args.search
+	search.Fields = make(map[string]string)
+	for key, value := range args.search.Fields {
+		search.Fields[key] = value
+	}
+
+	// Restrict to the candidate data nodes only
+	var validDataOptions []string
+	for dataNodeMatch := range dataNodeMatches {
+		validDataOptions = append(validDataOptions, dataNodeMatch)
+	}
+	sort.Strings(validDataOptions)
+	search.Fields["data_node"] = strings.Join(validDataOptions, " OR ")
+	// These data nodes are replicas
+	search.Fields["replica"] = "true"
+	if args.verbose {
+		fmt.Println(search)
+	}
+	return &replicaLookup{search: search, datasets: make(map[string]map[string][]sproket.Doc)}
+}
+
+// find returns the replicas of the files on the page by instance_id, only searching the datasets not already looked up
+func (r *replicaLookup) find(page []sproket.Doc) map[string][]sproket.Doc {
+	if r == nil || len(page) == 0 {
+		return nil
+	}
+	onPage := make(map[string]bool)
+	var missing []string
+	for _, doc := range page {
+		datasetID := doc.GetDatasetInstanceID()
+		if datasetID == "" || onPage[datasetID] {
+			continue
+		}
+		onPage[datasetID] = true
+		if _, in := r.datasets[datasetID]; !(in) {
+			missing = append(missing, datasetID)
+		}
+	}
+
+	// Results are not always sorted, so the files of a dataset may be spread across pages. Each dataset is kept
+	// once looked up, holding the replicas of its files not yet seen
+	for _, datasetID := range missing {
+		r.datasets[datasetID] = make(map[string][]sproket.Doc)
+	}
+
+	// Find candidate docs, the instance_id key verifies the replica is of the true latest version
+	for first := 0; first < len(missing); first += replicaBatch {
+		last := first + replicaBatch
+		if last > len(missing) {
+			last = len(missing)
+		}
+		r.search.Fields["dataset_id"] = sproket.DatasetMatch(missing[first:last])
+		pages := r.search.Pages(250)
+		for pages.Next() {
+			for _, doc := range pages.Docs() {
+				if files, in := r.datasets[doc.GetDatasetInstanceID()]; in {
+					files[doc.InstanceID] = append(files[doc.InstanceID], doc)
+				}
+			}
+		}
+	}
+
+	found := make(map[string][]sproket.Doc)
+	for _, doc := range page {
+		if files, in := r.datasets[doc.GetDatasetInstanceID()]; in {
+			found[doc.InstanceID] = files[doc.InstanceID]
+			delete(files, doc.InstanceID)
+		}
+	}
+	return found
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Orders of -order to download files in
+const (
+	orderSizeAsc  = "size-asc"
+	orderSizeDesc = "size-desc"
+	orderName     = "name"
+)
+
+// selecting reports whether the resolved tasks need to be sliced or sampled before download
+func (args *config) selecting() bool {
+	return args.limit > 0 || args.offset > 0 || args.sample > 0
+}
+
+// orderTasks sorts the tasks into the -order to download them in, if one was specified
+func orderTasks(args *config, tasks []*task) []*task {
+	// Ties fall back to instance_id so the order is the same every run
+	byName := func(i, j int) bool {
+		return tasks[i].InstanceID < tasks[j].InstanceID
+	}
+	switch args.order {
+	case orderSizeAsc:
+		sort.SliceStable(tasks, func(i, j int) bool {
+			if tasks[i].Docs[0].Size != tasks[j].Docs[0].Size {
+				return tasks[i].Docs[0].Size < tasks[j].Docs[0].Size
+			}
+			return byName(i, j)
+		})
+	case orderSizeDesc:
+		sort.SliceStable(tasks, func(i, j int) bool {
+			if tasks[i].Docs[0].Size != tasks[j].Docs[0].Size {
+				return tasks[i].Docs[0].Size > tasks[j].Docs[0].Size
+			}
+			return byName(i, j)
+		})
+	case orderName:
+		sort.SliceStable(tasks, byName)
+	}
+	return tasks
+}
+
+// selectedCount returns how many of n matching files the selection flags leave
+func selectedCount(args *config, n int) int {
+	n -= args.offset
+	if args.sample > 0 && args.sample < n {
+		n = args.sample
+	} else if args.limit > 0 && args.limit < n {
+		n = args.limit
+	}
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// selectTasks applies -offset, then -sample or -limit, to the resolved tasks in instance_id order
+func selectTasks(args *config, tasks []*task) []*task {
+	if !(args.selecting()) {
+		return tasks
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].InstanceID < tasks[j].InstanceID
+	})
+
+	if args.offset >= len(tasks) {
+		tasks = nil
+	} else {
+		tasks = tasks[args.offset:]
+	}
+
+	if args.sample > 0 && args.sample < len(tasks) {
+		seed := args.seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		picks := rand.New(rand.NewSource(seed)).Perm(len(tasks))[:args.sample]
+		sort.Ints(picks)
+		var sampled []*task
+		for _, pick := range picks {
+			sampled = append(sampled, tasks[pick])
+		}
+		tasks = sampled
+		if !(args.urlsOnly) {
+			fmt.Printf("sampled %d files with -seed %d\n", len(tasks), seed)
+		}
+	} else if args.limit > 0 && args.limit < len(tasks) {
+		tasks = tasks[:args.limit]
+	}
+	if !(args.urlsOnly) {
+		fmt.Printf("selected %d files for download\n", len(tasks))
+	}
+	return tasks
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyPause pauses downloads on SIGUSR1 and resumes them on SIGUSR2
+func notifyPause(g *gate) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			paused := (sig == syscall.SIGUSR1)
+			if paused {
+				fmt.Println("downloads paused, send SIGUSR2 to resume")
+			} else {
+				fmt.Println("downloads resumed")
+			}
+			g.setPaused(paused)
+		}
+	}()
+}
@@ -0,0 +1,4 @@
+package main
+
+// notifyPause does nothing, Windows has no SIGUSR1 or SIGUSR2 to pause and resume with
+func notifyPause(g *gate) {}
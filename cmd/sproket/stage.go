@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sproket"
+	"strings"
+	"time"
+)
+
+// partPath returns where the partial download for doc is written, in the staging directory if there is one
+func partPath(args *config, doc sproket.Doc) string {
+	if args.stageDir == "" {
+		return fmt.Sprintf("%s.part", destPath(args, doc))
+	}
+	return fmt.Sprintf("%s.part", filepath.Join(args.stageDir, filepath.FromSlash(relPath(args, doc))))
+}
+
+// heldPath returns where a verified file is kept by -require.complete until its dataset is complete, next to
+// its partial download
+func heldPath(args *config, doc sproket.Doc) string {
+	return fmt.Sprintf("%s.held", strings.TrimSuffix(partPath(args, doc), ".part"))
+}
+
+// moveFile moves a complete download at src to dest, flushing it to disk first unless -no.fsync so a crash
+// can not leave a truncated file under its final name. A staging directory on another filesystem is copied from
+func moveFile(args *config, src string, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if !(args.noFsync) {
+		if err := syncFile(src); err != nil {
+			return err
+		}
+	}
+	err := os.Rename(src, dest)
+	if err != nil && args.stageDir != "" {
+		err = copyFile(args, src, dest)
+	}
+	if err != nil {
+		return err
+	}
+	if !(args.noFsync) {
+		return syncDir(filepath.Dir(dest))
+	}
+	return nil
+}
+
+// copyFile copies src next to dest then renames it into place, removing src once done
+func copyFile(args *config, src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := fmt.Sprintf("%s.part", dest)
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil && !(args.noFsync) {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		return err
+	}
+	in.Close()
+	return os.Remove(src)
+}
+
+// syncFile flushes the file at path to disk
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// cleanPartials removes partial downloads, and their resume state, last written longer ago than -partials.age.
+// Verified files held by -require.complete are kept
+func cleanPartials(args *config) {
+	if args.partialsAge <= 0 || args.store != nil {
+		return
+	}
+	dir := args.outDir
+	if args.stageDir != "" {
+		dir = args.stageDir
+	}
+	removed := 0
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		name := info.Name()
+		if !(strings.HasSuffix(name, ".part") || strings.HasSuffix(name, ".part.chunks") || strings.HasSuffix(name, ".part.chunks.tmp")) {
+			return nil
+		}
+		if time.Since(info.ModTime()) < args.partialsAge {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			fmt.Println(err)
+			return nil
+		}
+		if args.verbose {
+			fmt.Printf("removed stale partial download %s\n", path)
+		}
+		removed++
+		size += info.Size()
+		return nil
+	})
+	if removed != 0 {
+		fmt.Printf("removed %d stale partial downloads (%s) older than %s\n", removed, formatSize(size), args.partialsAge)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sproket"
+	"strings"
+)
+
+// objectStore places downloads in an object store, when -out.dir is an s3:// URL, instead of a directory
+type objectStore struct {
+	s3     *sproket.S3
+	bucket string
+	prefix string
+}
+
+// isObjectStore reports whether the output directory is an object store URL
+func isObjectStore(outDir string) bool {
+	return strings.HasPrefix(outDir, "s3://")
+}
+
+// newObjectStore configures the object store named by outDir, credentials come from the environment
+func newObjectStore(outDir string, client *sproket.Client) (*objectStore, error) {
+	bucket, prefix, err := sproket.ParseS3URL(outDir)
+	if err != nil {
+		return nil, err
+	}
+	s3, err := sproket.NewS3FromEnv(client)
+	if err != nil {
+		return nil, err
+	}
+	return &objectStore{s3: s3, bucket: bucket, prefix: prefix}, nil
+}
+
+// key returns the object key for the file of doc
+func (o *objectStore) key(args *config, doc sproket.Doc) string {
+	if o.prefix == "" {
+		return relPath(args, doc)
+	}
+	return fmt.Sprintf("%s/%s", o.prefix, relPath(args, doc))
+}
+
+// getObject streams the file of doc into the object store, completing the upload only once the checksum is verified
+func getObject(id int, doc sproket.Doc, args *config) error {
+	key := args.store.key(args, doc)
+	dest := fmt.Sprintf("s3://%s/%s", args.store.bucket, key)
+
+	// Check if object is already present and correct, by the checksum stored with it
+	metadata, present, err := args.store.s3.Metadata(args.store.bucket, key)
+	if err != nil {
+		return fmt.Errorf("unable to check %s: %s", dest, err)
+	}
+	if present && doc.GetSum() != "" && metadata["checksum"] == doc.GetSum() {
+		if args.verbose {
+			fmt.Printf("%d: %s already present and verified, no download\n", id, dest)
+		}
+		if args.manifest != nil {
+			args.manifest.record(doc, dest)
+		}
+		args.catalog.record(doc, dest)
+		args.completeness.present(doc)
+		return nil
+	}
+
+	// Respect the per data node limit on concurrent downloads
+	release := args.hostSlots.acquire(doc.DataNode)
+	defer release()
+
+	h, hashErr := getHasher(dest, doc.GetSum(), doc.GetSumType())
+	if hashErr != nil && !(args.noVerify) {
+		return fmt.Errorf("%s, it cannot be verified so it is not uploaded", hashErr)
+	}
+	verify := (hashErr == nil && !(args.noVerify))
+
+	// Stream straight from the data node to the object store, hashing on the way. An upload can not be
+	// resumed, so one stopped by the gate closing starts over once downloads are allowed again
+	var upload *sproket.S3Upload
+	for {
+		args.gate.wait()
+		upload, err = args.store.s3.NewUpload(args.store.bucket, key, doc.Size, map[string]string{
+			"checksum":      doc.GetSum(),
+			"checksum-type": doc.GetSumType(),
+			"instance-id":   doc.InstanceID,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to start upload to %s: %s", dest, err)
+		}
+		var writer io.Writer = upload
+		if verify {
+			writer = io.MultiWriter(h, upload)
+		}
+		ctx, cancel := args.gate.open()
+		err = args.search.Client.GetContext(ctx, doc.HTTPURL, writer)
+		closed := (ctx.Err() != nil)
+		cancel()
+		if err == nil {
+			break
+		}
+		upload.Abort()
+		if !(closed) {
+			return fmt.Errorf("an error occurred during download of %s:\n\t%s", doc.HTTPURL, err)
+		}
+		fmt.Printf("%d: downloads paused, %s restarts once they are allowed\n", id, dest)
+		if h != nil {
+			h.Reset()
+		}
+	}
+	if verify && fmt.Sprintf("%x", h.Sum(nil)) != doc.GetSum() {
+		upload.Abort()
+		return fmt.Errorf("checksum verification failure for %s", dest)
+	}
+	if err := upload.Complete(); err != nil {
+		upload.Abort()
+		return err
+	}
+	if args.verbose {
+		fmt.Printf("%d: verified and stored %s\n", id, dest)
+	}
+
+	if args.manifest != nil {
+		args.manifest.record(doc, dest)
+	}
+	args.catalog.record(doc, dest)
+	args.completeness.present(doc)
+	args.hooks.fileDone(id, doc, dest)
+	return nil
+}
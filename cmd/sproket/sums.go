@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sproket"
+	"strings"
+	"sync"
+)
+
+// checksumList keeps a sha256sums.txt or md5sums.txt in the output directory, listing every verified file with
+// its remote checksum in the format read by sha256sum -c and md5sum -c
+type checksumList struct {
+	sumType  string
+	path     string
+	outDir   string
+	sums     map[string]string
+	file     *os.File
+	rewrite  bool
+	mismatch int
+	mutex    sync.Mutex
+}
+
+// newChecksumList opens the list for the checksum type, keeping the entries already in it
+func newChecksumList(sumType string, outDir string) (*checksumList, error) {
+	sumType = strings.ToLower(sumType)
+	if sumType != "sha256" && sumType != "md5" {
+		return nil, fmt.Errorf("-sums must be sha256 or md5, not %s", sumType)
+	}
+	l := checksumList{
+		sumType: sumType,
+		path:    filepath.Join(outDir, fmt.Sprintf("%ssums.txt", sumType)),
+		outDir:  outDir,
+		sums:    make(map[string]string),
+	}
+
+	// Entries from earlier runs are kept
+	if existing, err := os.Open(l.path); err == nil {
+		scanner := bufio.NewScanner(existing)
+		for scanner.Scan() {
+			sum, rel, found := strings.Cut(scanner.Text(), "  ")
+			if found {
+				l.sums[rel] = sum
+			}
+		}
+		existing.Close()
+	}
+
+	var err error
+	l.file, err = os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// record adds a verified file placed at dest to the list, if its checksum is of the listed type
+func (l *checksumList) record(doc sproket.Doc, dest string) {
+	if l == nil {
+		return
+	}
+	rel, err := filepath.Rel(l.outDir, dest)
+	if err != nil {
+		return
+	}
+	rel = filepath.ToSlash(rel)
+	sum := strings.ToLower(doc.GetSum())
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if strings.ToLower(doc.GetSumType()) != l.sumType || sum == "" {
+		l.mismatch++
+		return
+	}
+	previous, in := l.sums[rel]
+	if in && previous == sum {
+		return
+	}
+	// A changed entry can not be appended, the whole list is written again once the run completes
+	l.rewrite = l.rewrite || in
+	l.sums[rel] = sum
+	if !(l.rewrite) {
+		if _, err := fmt.Fprintf(l.file, "%s  %s\n", sum, rel); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// close finishes the list, writing it again in full if any entry changed
+func (l *checksumList) close() error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.mismatch != 0 {
+		fmt.Printf("%d files left out of %s, their checksums are not %s\n", l.mismatch, l.path, l.sumType)
+		l.mismatch = 0
+	}
+	if err := l.file.Close(); err != nil || !(l.rewrite) {
+		return err
+	}
+
+	var rels []string
+	for rel := range l.sums {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+	var lines strings.Builder
+	for _, rel := range rels {
+		fmt.Fprintf(&lines, "%s  %s\n", l.sums[rel], rel)
+	}
+	tmp := fmt.Sprintf("%s.tmp", l.path)
+	if err := os.WriteFile(tmp, []byte(lines.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
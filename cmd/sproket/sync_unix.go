@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+import "os"
+
+// syncDir flushes the directory entries of dir to disk, so a rename into it survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
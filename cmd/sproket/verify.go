@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"sproket"
+	"sync"
+)
+
+// verification is a file left for a verification worker to hash, so hashing large files does not hold up downloads
+type verification struct {
+	t        *task
+	index    int
+	path     string
+	final    string
+	existing bool
+}
+
+// verifier runs the verification workers, and keeps count of the tasks outstanding across both pools of workers
+type verifier struct {
+	workers int
+	jobs    chan *verification
+	tasks   chan<- *task
+	pending sync.WaitGroup
+	waiter  sync.WaitGroup
+}
+
+// newVerifier starts -verify.p verification workers, tasks they fail over are sent back to tasks
+func newVerifier(args *config, tasks chan<- *task) *verifier {
+	v := &verifier{
+		workers: args.verifyParallel,
+		jobs:    make(chan *verification),
+		tasks:   tasks,
+	}
+	for id := 0; id < v.workers; id++ {
+		v.waiter.Add(1)
+		go v.run(id, args)
+	}
+	return v
+}
+
+// offload reports whether files should be left for the verification workers to hash
+func (v *verifier) offload() bool {
+	return v != nil && v.workers > 0
+}
+
+// add counts a newly submitted task
+func (v *verifier) add() {
+	v.pending.Add(1)
+}
+
+// done counts a task as over, completed or failed
+func (v *verifier) done() {
+	if v == nil {
+		return
+	}
+	v.pending.Done()
+}
+
+// wait waits for every task submitted to be over
+func (v *verifier) wait() {
+	v.pending.Wait()
+}
+
+// submit hands a file over to the verification workers
+func (v *verifier) submit(job *verification) {
+	v.jobs <- job
+}
+
+// retry sends a task back to the download workers, without blocking the verification worker
+func (v *verifier) retry(t *task) {
+	go func() {
+		v.tasks <- t
+	}()
+}
+
+// close stops the verification workers once they are idle
+func (v *verifier) close() {
+	close(v.jobs)
+	v.waiter.Wait()
+}
+
+func (v *verifier) run(id int, args *config) {
+	defer v.waiter.Done()
+	for job := range v.jobs {
+		verifyTask(id, job, args)
+	}
+}
+
+// verifyTask hashes the file of a verification, then finishes its task or sends it back to be downloaded again
+func verifyTask(id int, job *verification, args *config) {
+	t := job.t
+	doc := t.Docs[job.index]
+	retried := false
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("verify %d: internal error handling %s: %v\n", id, t.InstanceID, r)
+			args.failed.add(args, t)
+		}
+		if !(retried) {
+			args.verifier.done()
+		}
+	}()
+
+	err := check(job.path, doc.GetSum(), doc.GetSumType())
+	if job.existing {
+		if err == nil {
+			presentFile(id, doc, args, job.final)
+			finishTask(args, t)
+			return
+		}
+		// The file present is not a valid copy, download it again
+		t.next = job.index
+		t.checked = true
+		retried = true
+		args.verifier.retry(t)
+		return
+	}
+
+	if err == nil {
+		if args.verbose {
+			fmt.Printf("verify %d: verified %s\n", id, job.path)
+		}
+		err = placeFile(id, doc, args, job.path, job.final)
+		if err == nil {
+			finishTask(args, t)
+			return
+		}
+	} else if args.chunks > 1 {
+		// A resumable segmented download must not resume from corrupt chunks
+		sproket.RemoveChunked(job.path)
+	}
+
+	fmt.Printf("verify %d: %s\n", id, err)
+	if job.index+1 < len(t.Docs) {
+		fmt.Printf("verify %d: failing over to %s\n", id, t.Docs[job.index+1].DataNode)
+		t.next = job.index + 1
+		retried = true
+		args.verifier.retry(t)
+		return
+	}
+	args.failed.add(args, t)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// watch repeats the search every interval, downloading only the files that are not yet in the manifest
+func watch(args *config) {
+	for {
+		started := time.Now()
+		fmt.Printf("%s: searching for new files\n", started.Format(time.RFC3339))
+		before := args.manifest.size()
+		getBySearch(args)
+		if arrived := args.manifest.size() - before; arrived > 0 {
+			fmt.Printf("%s: %d new files arrived\n", time.Now().Format(time.RFC3339), arrived)
+		}
+
+		next := started.Add(args.interval)
+		fmt.Printf("next search at %s\n", next.Format(time.RFC3339))
+		time.Sleep(time.Until(next))
+		if err := nextCycle(args); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+}
+
+// nextCycle resets the state kept for a single run, so each search of -watch reports only its own files
+func nextCycle(args *config) error {
+	args.failed = failedQueue{}
+	args.hooks.reset()
+	args.large.held, args.large.heldSize = nil, 0
+	args.budget.reset()
+	args.completeness = newCompleteness(args.requireComplete)
+	// Each search should see what has been published since the last
+	args.search.Client.Cache.Clear()
+	if args.sumsType != "" {
+		var err error
+		args.sums, err = newChecksumList(args.sumsType, args.outDir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gate holds back downloads outside of the allowed download window or while paused by a signal
+type gate struct {
+	windowed bool
+	start    time.Duration
+	end      time.Duration
+	paused   bool
+	changed  chan struct{}
+	mutex    sync.Mutex
+}
+
+// newGate builds a gate for a daily window like "22:00-06:00", an empty window is always open
+func newGate(window string) (*gate, error) {
+	g := gate{changed: make(chan struct{})}
+	if window == "" {
+		return &g, nil
+	}
+	bounds := strings.Split(window, "-")
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("invalid window %s, expected a form like 22:00-06:00", window)
+	}
+	var err error
+	if g.start, err = parseClock(bounds[0]); err != nil {
+		return nil, err
+	}
+	if g.end, err = parseClock(bounds[1]); err != nil {
+		return nil, err
+	}
+	g.windowed = (g.start != g.end)
+	return &g, nil
+}
+
+// parseClock converts a HH:MM time of day to the offset from midnight
+func parseClock(clock string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(clock))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %s, expected HH:MM", clock)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// untilOpen returns how long until the window opens at now, zero if it is open
+func (g *gate) untilOpen(now time.Time) time.Duration {
+	if !(g.windowed) {
+		return 0
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	offset := now.Sub(midnight)
+	inWindow := (offset >= g.start && offset < g.end)
+	if g.start > g.end {
+		// The window wraps past midnight
+		inWindow = (offset >= g.start || offset < g.end)
+	}
+	if inWindow {
+		return 0
+	}
+	wait := g.start - offset
+	if wait < 0 {
+		wait += 24 * time.Hour
+	}
+	return wait
+}
+
+// setPaused pauses or resumes downloads, waking any waiting workers
+func (g *gate) setPaused(paused bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.paused = paused
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+// wait blocks until downloads are allowed
+func (g *gate) wait() {
+	for {
+		g.mutex.Lock()
+		paused := g.paused
+		changed := g.changed
+		g.mutex.Unlock()
+
+		wait := g.untilOpen(time.Now())
+		if !(paused) && wait == 0 {
+			return
+		}
+		// Check the window again periodically while paused
+		if paused || wait > time.Hour {
+			wait = time.Hour
+		}
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// untilClose returns how long the window stays open from now, which must be inside it
+func (g *gate) untilClose(now time.Time) time.Duration {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	wait := g.end - now.Sub(midnight)
+	if wait <= 0 {
+		wait += 24 * time.Hour
+	}
+	return wait
+}
+
+// open returns a context for a transfer started once the gate is open, it is cancelled as soon as downloads
+// are paused or the window closes so the transfer stops there rather than holding its connection open
+func (g *gate) open() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var closing <-chan time.Time
+	if g.windowed {
+		timer := time.NewTimer(g.untilClose(time.Now()))
+		closing = timer.C
+		go func() {
+			<-ctx.Done()
+			timer.Stop()
+		}()
+	}
+	go func() {
+		for {
+			g.mutex.Lock()
+			paused := g.paused
+			changed := g.changed
+			g.mutex.Unlock()
+			if paused {
+				cancel()
+				return
+			}
+			select {
+			case <-changed:
+			case <-closing:
+				cancel()
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ctx, cancel
+}
@@ -1,12 +1,34 @@
 package sproket
 
-import "net/http"
-
-// Search holds the ESGF search API to use and criteria to apply
+// Search holds the ESGF search APIs to use and criteria to apply
 type Search struct {
-	API              string            `json:"search_api"`
-	Fields           map[string]string `json:"fields"`
-	DataNodePriority []string          `json:"data_node_priority"`
-	Agent            string
-	HTTPClient       *http.Client
+	API               Endpoints           `json:"search_api"`
+	SearchBackend     string              `json:"search_backend"`
+	STACCollection    string              `json:"stac_collection"`
+	STACPrefix        string              `json:"stac_prefix"`
+	Federate          bool                `json:"federate"`
+	Distrib           *bool               `json:"distrib"`
+	Fields            map[string]string   `json:"fields"`
+	Query             string              `json:"query"`
+	Version           string              `json:"version"`
+	Start             string              `json:"start"`
+	End               string              `json:"end"`
+	BBox              []float64           `json:"bbox"`
+	DataNodePriority  []string            `json:"data_node_priority"`
+	DataNodeExclude   []string            `json:"data_node_exclude"`
+	DataNodeOnly      []string            `json:"data_node_only"`
+	Protocols         []string            `json:"protocols"`
+	DataNodeProtocols map[string][]string `json:"data_node_protocols"`
+	ValuesForAllow    []string            `json:"values_for_allow"`
+	ValuesForBlock    []string            `json:"values_for_block"`
+	CABundle          string              `json:"ca_bundle"`
+	ClientCert        string              `json:"client_cert"`
+	ClientKey         string              `json:"client_key"`
+	ConnectTimeout    string              `json:"connect_timeout"`
+	ReadTimeout       string              `json:"read_timeout"`
+	Proxy             string              `json:"proxy"`
+	HTTP2             *bool               `json:"http2"`
+	FileFacets        []string            `json:"-"`
+	Client            *Client             `json:"-"`
+	Backend           Backend             `json:"-"`
 }
@@ -0,0 +1,84 @@
+package sproket
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+type datasetRes struct {
+	Res datasetResponse `json:"response"`
+}
+
+type datasetResponse struct {
+	N    int       `json:"numFound"`
+	Docs []Dataset `json:"docs"`
+}
+
+// Dataset holds a single dataset search result, the collection of files a file's dataset_id refers to
+type Dataset struct {
+	InstanceID string `json:"instance_id"`
+	DataNode   string `json:"data_node"`
+	Files      int    `json:"number_of_files"`
+	Size       int64  `json:"size"`
+}
+
+// SearchDatasets returns a slice of up to "limit" datasets matching the search, and the number remaining
+func (s *Search) SearchDatasets(skip int, limit int) ([]Dataset, int) {
+	q := s.buildQ()
+	params := map[string]string{
+		"query":  q,
+		"type":   "Dataset",
+		"format": "application/solr+json",
+		"fields": "instance_id,data_node,number_of_files,size",
+		"limit":  fmt.Sprintf("%d", limit),
+		"offset": fmt.Sprintf("%d", skip),
+	}
+
+	body, err := s.performSearch(params)
+	if err != nil {
+		fmt.Println(err)
+		return nil, 0
+	}
+
+	// Parse response body as JSON
+	var result datasetRes
+	json.Unmarshal(body, &result)
+
+	remaining := result.Res.N - (len(result.Res.Docs) + skip)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return result.Res.Docs, remaining
+}
+
+// DatasetMatch returns a value for the dataset_id field matching the files of the datasets, on any data node
+func DatasetMatch(instanceIDs []string) string {
+	var matches []string
+	for _, instanceID := range instanceIDs {
+		// dataset_id is the dataset instance_id followed by |data_node
+		matches = append(matches, fmt.Sprintf("%s\\|*", escapeTerm(instanceID)))
+	}
+	return strings.Join(matches, " OR ")
+}
+
+// TermMatch returns a field value matching any of the values exactly
+func TermMatch(values []string) string {
+	var matches []string
+	for _, value := range values {
+		matches = append(matches, escapeTerm(value))
+	}
+	return strings.Join(matches, " OR ")
+}
+
+// escapeTerm escapes the characters with special meaning in a Solr query term
+func escapeTerm(term string) string {
+	var escaped strings.Builder
+	for _, r := range term {
+		if strings.ContainsRune(`\+-!():^[]"{}~*?|&/ `, r) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
@@ -1,8 +1,11 @@
 package sproket
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"sync"
 )
 
 type facetRes struct {
@@ -11,10 +14,42 @@ type facetRes struct {
 
 type facetCounts struct {
 	Fields map[string][]interface{} `json:"facet_fields"`
+	Pivots map[string][]Pivot       `json:"facet_pivot"`
+}
+
+// Pivot holds the number of files with a value of a field, and the counts of the next field's values within those files
+type Pivot struct {
+	Field string  `json:"field"`
+	Value string  `json:"value"`
+	Count int     `json:"count"`
+	Pivot []Pivot `json:"pivot"`
+}
+
+// PartialError reports that only some of the requested fields could be faceted
+type PartialError struct {
+	Missing []string
+	Err     error
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("partial results, no values for %s: %s", strings.Join(e.Missing, ", "), e.Err)
+}
+
+func (e *PartialError) Unwrap() error {
+	return e.Err
 }
 
 // Facet returns the values available for the provided field and the number of files that each value has
 func (s *Search) Facet(field string) map[string]int {
+	valueCounts, err := s.FacetContext(context.Background(), field)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return valueCounts
+}
+
+// FacetContext is Facet, giving up once ctx is done
+func (s *Search) FacetContext(ctx context.Context, field string) (map[string]int, error) {
 	q := s.buildQ()
 	params := map[string]string{
 		"query":  q,
@@ -24,15 +59,21 @@ func (s *Search) Facet(field string) map[string]int {
 		"facets": field,
 	}
 
-	body, err := s.performSearch(params)
-	if err != nil {
-		fmt.Println(err)
-		return nil
-	}
-
-	// Parse response body as JSON
+	// Parse response body as JSON, merging the responses of every index when federating
 	var result facetRes
-	json.Unmarshal(body, &result)
+	if s.Federate {
+		bodies, err := s.performFederated(ctx, s.withDistrib(params))
+		if err != nil {
+			return nil, err
+		}
+		result = mergeFacetResults(bodies)
+	} else {
+		body, err := s.performSearchContext(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		json.Unmarshal(body, &result)
+	}
 
 	valueCounts := make(map[string]int)
 	var prev string
@@ -43,5 +84,84 @@ func (s *Search) Facet(field string) map[string]int {
 			valueCounts[prev] = int(count)
 		}
 	}
-	return valueCounts
+	return valueCounts, nil
+}
+
+// FacetsContext facets each of the provided fields at once, returning the fields completed along
+// with a *PartialError if ctx is done or a search fails before all fields are faceted
+func (s *Search) FacetsContext(ctx context.Context, fields []string) (map[string]map[string]int, error) {
+	counts := make([]map[string]int, len(fields))
+	errs := make([]error, len(fields))
+	waiter := sync.WaitGroup{}
+	for i, field := range fields {
+		waiter.Add(1)
+		go func(i int, field string) {
+			defer waiter.Done()
+			counts[i], errs[i] = s.FacetContext(ctx, field)
+		}(i, field)
+	}
+	waiter.Wait()
+
+	results := make(map[string]map[string]int)
+	var partial *PartialError
+	for i, field := range fields {
+		if errs[i] != nil {
+			if partial == nil {
+				partial = &PartialError{Err: errs[i]}
+			}
+			partial.Missing = append(partial.Missing, field)
+			continue
+		}
+		results[field] = counts[i]
+	}
+	if partial != nil {
+		return results, partial
+	}
+	return results, nil
+}
+
+// WithFields returns a copy of the search with the provided fields set, an empty value removes a field.
+// The copy can be searched alongside the original
+func (s *Search) WithFields(fields map[string]string) *Search {
+	copied := *s
+	copied.Fields = make(map[string]string)
+	for key, value := range s.Fields {
+		copied.Fields[key] = value
+	}
+	for key, value := range fields {
+		if value == "" {
+			delete(copied.Fields, key)
+		} else {
+			copied.Fields[key] = value
+		}
+	}
+	return &copied
+}
+
+// FacetPivot returns the file counts for each combination of values of the provided fields, nested in field order
+func (s *Search) FacetPivot(fields []string) []Pivot {
+	if len(fields) == 0 {
+		return nil
+	}
+	pivot := strings.Join(fields, ",")
+	q := s.buildQ()
+	params := map[string]string{
+		"query":       q,
+		"type":        "File",
+		"format":      "application/solr+json",
+		"limit":       "0",
+		"facets":      pivot,
+		"facet.pivot": pivot,
+	}
+
+	body, err := s.performSearch(params)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+
+	// Parse response body as JSON
+	var result facetRes
+	json.Unmarshal(body, &result)
+	return result.Counts.Pivots[pivot]
 }
@@ -0,0 +1,184 @@
+package sproket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Endpoints holds the search API URLs to use in priority order, configured as a single URL or a list
+type Endpoints []string
+
+// UnmarshalJSON accepts either a single URL string or a list of URLs
+func (e *Endpoints) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*e = nil
+		if single != "" {
+			*e = Endpoints{single}
+		}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.New("search_api must be a URL or a list of URLs")
+	}
+	*e = Endpoints(list)
+	return nil
+}
+
+func (e Endpoints) String() string {
+	return strings.Join(e, ", ")
+}
+
+// performFederated performs the search against every endpoint at once, returning the responses of those that succeeded
+func (s *Search) performFederated(ctx context.Context, params map[string]string) ([][]byte, error) {
+	each := make([]map[string]string, len(s.API))
+	for i := range each {
+		each[i] = params
+	}
+	responses, err := s.performEach(ctx, each)
+	if err != nil {
+		return nil, err
+	}
+	var bodies [][]byte
+	for _, body := range responses {
+		if body != nil {
+			bodies = append(bodies, body)
+		}
+	}
+	return bodies, nil
+}
+
+// performEach performs a search against each endpoint at once with that endpoint's params, skipping those
+// with none. The responses line up with the endpoints, nil where the search was skipped or failed
+func (s *Search) performEach(ctx context.Context, params []map[string]string) ([][]byte, error) {
+	bodies := make([][]byte, len(s.API))
+	errs := make([]error, len(s.API))
+	waiter := sync.WaitGroup{}
+	for i, endpoint := range s.API {
+		if params[i] == nil {
+			continue
+		}
+		waiter.Add(1)
+		go func(i int, endpoint string) {
+			defer waiter.Done()
+			bodies[i], errs[i] = s.performEndpoint(ctx, endpoint, params[i])
+		}(i, endpoint)
+	}
+	waiter.Wait()
+
+	var messages []string
+	succeeded := 0
+	for i, err := range errs {
+		if err != nil {
+			messages = append(messages, fmt.Sprintf("%s: %s", s.API[i], err))
+			bodies[i] = nil
+		} else if params[i] != nil {
+			succeeded++
+		}
+	}
+	if succeeded == 0 {
+		return nil, fmt.Errorf("every search API failed: %s", strings.Join(messages, "; "))
+	}
+	return bodies, nil
+}
+
+// stepFederated performs the search against every index not yet ended, each from its own offset since the
+// indexes hold different numbers of files. The offsets advance by the files each index returned, and an
+// index is ended once it has returned all of its files. The responses line up with the endpoints
+func (s *Search) stepFederated(params map[string]string, offsets []int, ended []bool) ([][]byte, error) {
+	each := make([]map[string]string, len(s.API))
+	for i := range s.API {
+		if ended[i] {
+			continue
+		}
+		each[i] = make(map[string]string)
+		for key, value := range params {
+			each[i][key] = value
+		}
+		each[i]["offset"] = fmt.Sprintf("%d", offsets[i])
+	}
+	bodies, err := s.performEach(context.Background(), each)
+	if err != nil {
+		return nil, err
+	}
+	for i, body := range bodies {
+		if body == nil {
+			continue
+		}
+		var result SearchRes
+		json.Unmarshal(body, &result)
+		offsets[i] += len(result.Res.Docs)
+		ended[i] = len(result.Res.Docs) == 0 || offsets[i] >= result.Res.N
+	}
+	return bodies, nil
+}
+
+// searchFederatedPage fetches the next page of files from every index with files left
+func (s *Search) searchFederatedPage(offsets []int, ended []bool, limit int) ([]Doc, error) {
+	bodies, err := s.stepFederated(s.withDistrib(s.fileParams(limit)), offsets, ended)
+	if err != nil {
+		return nil, err
+	}
+	result := mergeSearchResults(bodies)
+	result.setHTTPURLs()
+	return result.Res.Docs, nil
+}
+
+// mergeSearchResults merges the results of a page from several indexes, removing
+// documents for the same file on the same data node that more than one index holds.
+// The count is the sum of the indexes' counts, an upper bound as files they share are counted for each
+func mergeSearchResults(bodies [][]byte) SearchRes {
+	var merged SearchRes
+	seen := make(map[string]bool)
+	for _, body := range bodies {
+		if body == nil {
+			continue
+		}
+		var result SearchRes
+		json.Unmarshal(body, &result)
+		merged.Res.N += result.Res.N
+		for _, doc := range result.Res.Docs {
+			key := fmt.Sprintf("%s|%s", doc.InstanceID, doc.DataNode)
+			if !(seen[key]) {
+				seen[key] = true
+				merged.Res.Docs = append(merged.Res.Docs, doc)
+			}
+		}
+	}
+	return merged
+}
+
+// mergeFacetResults merges facet counts from several indexes, summing the counts of each value. Like the
+// merged count of files, the sums are upper bounds as files the indexes share are counted for each
+func mergeFacetResults(bodies [][]byte) facetRes {
+	merged := facetRes{Counts: facetCounts{Fields: make(map[string][]interface{})}}
+	counts := make(map[string]map[string]float64)
+	for _, body := range bodies {
+		var result facetRes
+		json.Unmarshal(body, &result)
+		for field, values := range result.Counts.Fields {
+			if counts[field] == nil {
+				counts[field] = make(map[string]float64)
+			}
+			var prev string
+			for _, value := range values {
+				if key, ok := value.(string); ok {
+					prev = key
+				} else if count, ok := value.(float64); ok {
+					counts[field][prev] += count
+				}
+			}
+		}
+	}
+	for field, valueCounts := range counts {
+		for value, count := range valueCounts {
+			merged.Counts.Fields[field] = append(merged.Counts.Fields[field], value, count)
+		}
+	}
+	return merged
+}
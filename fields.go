@@ -1,6 +1,7 @@
 package sproket
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 )
@@ -15,6 +16,15 @@ type fieldResMid struct {
 
 // GetFields returns a slice of available fields for a search
 func (s *Search) GetFields() []string {
+	fields, err := s.GetFieldsContext(context.Background())
+	if err != nil {
+		fmt.Println(err)
+	}
+	return fields
+}
+
+// GetFieldsContext returns a slice of available fields for a search, giving up once ctx is done
+func (s *Search) GetFieldsContext(ctx context.Context) ([]string, error) {
 	q := s.buildQ()
 	params := map[string]string{
 		"query":  q,
@@ -24,10 +34,9 @@ func (s *Search) GetFields() []string {
 		"limit":  "1",
 	}
 
-	body, err := s.performSearch(params)
+	body, err := s.performSearchContext(ctx, params)
 	if err != nil {
-		fmt.Println(err)
-		return nil
+		return nil, err
 	}
 
 	// Parse response body as JSON
@@ -36,12 +45,12 @@ func (s *Search) GetFields() []string {
 
 	// If no result was found
 	if len(result.Res.Docs) != 1 {
-		return nil
+		return nil, nil
 	}
 
 	var fields []string
 	for key := range result.Res.Docs[0] {
 		fields = append(fields, key)
 	}
-	return fields
+	return fields, nil
 }
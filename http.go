@@ -0,0 +1,108 @@
+package sproket
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// HTTPOptions configures the HTTP client built by NewHTTPClient
+type HTTPOptions struct {
+	TLS            TLSFiles
+	TLSReload      time.Duration
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	Proxy          string
+	Connections    int
+	DisableHTTP2   bool
+}
+
+// NewHTTPClient builds an HTTP client from the options. Proxies come from HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// unless Proxy is set, and idle connections are kept for up to Connections concurrent requests to each host.
+func NewHTTPClient(opts HTTPOptions) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	tlsConfig, err := NewTLSConfig(opts.TLS, opts.TLSReload)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	if opts.Proxy != "" {
+		proxyURL, err := url.Parse(opts.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %s: %s", opts.Proxy, err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if opts.ConnectTimeout > 0 {
+		dialer.Timeout = opts.ConnectTimeout
+		transport.TLSHandshakeTimeout = opts.ConnectTimeout
+	}
+	transport.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil || opts.ReadTimeout <= 0 {
+			return conn, err
+		}
+		return &deadlineConn{Conn: conn, timeout: opts.ReadTimeout}, nil
+	}
+	if opts.ReadTimeout > 0 {
+		transport.ResponseHeaderTimeout = opts.ReadTimeout
+	}
+
+	// Connections verified by hand need the host dialed, which the transport does not pass on
+	if tlsConfig.VerifyConnection != nil {
+		transport.DialTLSContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			conn, err := transport.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			if transport.TLSHandshakeTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, transport.TLSHandshakeTimeout)
+				defer cancel()
+			}
+			tlsConn := tls.Client(conn, withHost(transport.TLSClientConfig, host))
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		}
+	}
+
+	// Every worker may be talking to the same data node, keep a connection around for each of them
+	if opts.Connections > transport.MaxIdleConnsPerHost {
+		transport.MaxIdleConnsPerHost = opts.Connections
+	}
+	if opts.Connections > transport.MaxIdleConns {
+		transport.MaxIdleConns = opts.Connections
+	}
+
+	if opts.DisableHTTP2 {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// deadlineConn fails a read once no data has arrived for timeout, so a stalled transfer is abandoned
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (d *deadlineConn) Read(p []byte) (int, error) {
+	d.Conn.SetReadDeadline(time.Now().Add(d.timeout))
+	return d.Conn.Read(p)
+}
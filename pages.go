@@ -0,0 +1,163 @@
+package sproket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// cursorStart is the cursorMark that starts a cursor search from the first result
+const cursorStart = "*"
+
+// cursorSort orders results by the unique key, which a cursor search requires to page consistently
+const cursorSort = "id asc"
+
+// Pages walks through every file matching the search a page at a time, using a Solr cursor when the index
+// node supports one and falling back to offsets otherwise. Call Next to fetch each page, then Docs to read it.
+type Pages struct {
+	s      *Search
+	limit  int
+	offset int
+	cursor string
+	docs   []Doc
+	done   bool
+
+	// A cursor is only valid at the search API that issued it, which is then the only one asked for pages.
+	// Offset pages keep to the cursor's sort once it has been used
+	endpoint string
+	sort     string
+
+	// Federated indexes are paged by an offset for each
+	offsets []int
+	ended   []bool
+}
+
+// Pages returns an iterator over the files matching the search, "limit" files per page
+func (s *Search) Pages(limit int) *Pages {
+	p := &Pages{s: s, limit: limit}
+	// Federated indexes each have their own cursor and number of files, so they page by their own offsets
+	if s.Federate {
+		p.offsets = make([]int, len(s.API))
+		p.ended = make([]bool, len(s.API))
+	} else if s.client().cursorSupported(s.API.String()) {
+		p.cursor = cursorStart
+	}
+	return p
+}
+
+// Next fetches the next page, returning false once every file has been read or a search fails
+func (p *Pages) Next() bool {
+	if p.done {
+		p.docs = nil
+		return false
+	}
+	if p.cursor != "" {
+		return p.nextCursor()
+	}
+	if p.s.Federate {
+		return p.nextFederated()
+	}
+	params := p.s.fileParams(p.limit)
+	params["offset"] = fmt.Sprintf("%d", p.offset)
+	if p.sort != "" {
+		params["sort"] = p.sort
+	}
+	result, err := p.s.searchFiles(params)
+	if err != nil {
+		fmt.Println(err)
+		p.done = true
+		p.docs = nil
+		return false
+	}
+	p.offset += len(result.Res.Docs)
+	p.docs = result.Res.Docs
+	p.done = p.offset >= result.Res.N || len(p.docs) == 0
+	return len(p.docs) != 0
+}
+
+// nextCursor fetches the next page using the cursor
+func (p *Pages) nextCursor() bool {
+	params := p.s.fileParams(p.limit)
+	params["sort"] = cursorSort
+	params["cursorMark"] = p.cursor
+	var result SearchRes
+	var body []byte
+	var err error
+	if p.endpoint == "" {
+		body, p.endpoint, err = p.s.performSearchFrom(context.Background(), params)
+	} else {
+		body, err = p.s.performEndpoint(context.Background(), p.endpoint, p.s.withDistrib(params))
+	}
+	if err == nil {
+		result = parseFiles(body)
+	}
+
+	// Older index nodes reject or ignore cursors, so continue by offset, which is only consistent from the start
+	if p.cursor == cursorStart && (rejectsCursor(err) || (err == nil && result.NextCursor == "")) {
+		p.s.client().noCursorSupport(p.s.API.String())
+		p.cursor = ""
+		p.endpoint = ""
+		return p.Next()
+	}
+
+	// Another search API can not continue the cursor, so continue there by offset in the same order
+	if err != nil && p.cursor != cursorStart && len(p.s.API) > 1 {
+		fmt.Printf("%s, continuing by offset with the other search APIs\n", err)
+		p.cursor = ""
+		p.endpoint = ""
+		p.sort = cursorSort
+		return p.Next()
+	}
+	if err != nil {
+		fmt.Println(err)
+		p.done = true
+		p.docs = nil
+		return false
+	}
+
+	// The cursor stops changing once the last page has been read
+	p.done = result.NextCursor == p.cursor || len(result.Res.Docs) == 0
+	p.cursor = result.NextCursor
+	p.docs = result.Res.Docs
+	p.offset += len(p.docs)
+	return len(p.docs) != 0
+}
+
+// rejectsCursor reports whether err is the index node refusing a cursor search, as opposed to failing it
+func rejectsCursor(err error) bool {
+	var status *StatusError
+	if !(errors.As(err, &status)) || status.Code != http.StatusBadRequest {
+		return false
+	}
+	message := strings.ToLower(status.Message)
+	return strings.Contains(message, "cursor") || strings.Contains(message, "sort")
+}
+
+// nextFederated fetches the next page from every index that has files left, until one yields files
+// not already seen on the page or every index has ended
+func (p *Pages) nextFederated() bool {
+	for {
+		docs, err := p.s.searchFederatedPage(p.offsets, p.ended, p.limit)
+		if err != nil {
+			fmt.Println(err)
+			p.done = true
+			p.docs = nil
+			return false
+		}
+		p.done = true
+		for _, ended := range p.ended {
+			p.done = p.done && ended
+		}
+		p.docs = docs
+		if len(docs) != 0 || p.done {
+			return len(docs) != 0
+		}
+	}
+}
+
+// Docs returns the files of the page fetched by the last call to Next
+func (p *Pages) Docs() []Doc {
+	return p.docs
+}
@@ -0,0 +1,98 @@
+package sproket
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ProbeBytes is the size of the range requested from a data node when probing it, large enough for the
+// transfer rather than the round trip to dominate
+const ProbeBytes = 4 * 1024 * 1024
+
+// ProbeResult holds the outcome of probing a single data node
+type ProbeResult struct {
+	DataNode   string
+	Available  bool
+	Latency    time.Duration
+	Throughput float64
+	Err        error
+}
+
+// Probe requests a small range of the provided URL and measures the latency and throughput of the data node serving it
+func (c *Client) Probe(dataNode string, inURL string) ProbeResult {
+	result := ProbeResult{DataNode: dataNode}
+
+	req, err := c.newRequest(context.Background(), "GET", inURL)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", ProbeBytes-1))
+
+	start := time.Now()
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer resp.Body.Close()
+	result.Latency = time.Since(start)
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		result.Err = fmt.Errorf("%s", resp.Status)
+		return result
+	}
+
+	// Throughput is timed from the first byte so the round trip does not count against it
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(resp.Body, first); err != nil {
+		result.Err = err
+		return result
+	}
+	firstByte := time.Now()
+
+	// Servers ignoring the Range header send the whole file, so only read the probe size
+	nBytes, err := io.Copy(io.Discard, io.LimitReader(resp.Body, ProbeBytes-1))
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	elapsed := time.Since(firstByte)
+	if elapsed > 0 {
+		result.Throughput = float64(nBytes) / elapsed.Seconds()
+	}
+	result.Available = true
+	return result
+}
+
+// RankDataNodes probes each data node using its sample URL and returns the results from best to worst
+func (c *Client) RankDataNodes(samples map[string]string) []ProbeResult {
+	results := make(chan ProbeResult)
+	for dataNode, sample := range samples {
+		go func(dataNode string, sample string) {
+			results <- c.Probe(dataNode, sample)
+		}(dataNode, sample)
+	}
+
+	var ranked []ProbeResult
+	for range samples {
+		ranked = append(ranked, <-results)
+	}
+
+	// Available nodes first, then by throughput, then by latency
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if a.Available != b.Available {
+			return a.Available
+		}
+		if a.Throughput != b.Throughput {
+			return a.Throughput > b.Throughput
+		}
+		return a.Latency < b.Latency
+	})
+	return ranked
+}
@@ -0,0 +1,94 @@
+package sproket
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// rangeLayouts are the accepted forms of the start and end times, from most to least precise
+var rangeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02", "2006-01", "2006"}
+
+// SolrTime converts a date like 1980, 1980-06 or 1980-06-01 to the timestamp form used by the index
+func SolrTime(value string) (string, error) {
+	t, _, err := parseTime(value)
+	if err != nil {
+		return "", err
+	}
+	return t.UTC().Format("2006-01-02T15:04:05Z"), nil
+}
+
+// SolrEndTime is SolrTime for the end of a range, a partial date is taken to the last second of the year, month
+// or day it names so that -end 2010 includes all of 2010
+func SolrEndTime(value string) (string, error) {
+	t, layout, err := parseTime(value)
+	if err != nil {
+		return "", err
+	}
+	switch layout {
+	case "2006":
+		t = t.AddDate(1, 0, 0).Add(-time.Second)
+	case "2006-01":
+		t = t.AddDate(0, 1, 0).Add(-time.Second)
+	case "2006-01-02":
+		t = t.AddDate(0, 0, 1).Add(-time.Second)
+	}
+	return t.UTC().Format("2006-01-02T15:04:05Z"), nil
+}
+
+// parseTime parses a start or end time, returning the layout it was given in
+func parseTime(value string) (time.Time, string, error) {
+	for _, layout := range rangeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, layout, nil
+		}
+	}
+	return time.Time{}, "", fmt.Errorf("invalid time %s, expected a form like 1980-06-01", value)
+}
+
+// ValidateRanges checks the start, end and bbox options
+func (s *Search) ValidateRanges() error {
+	for _, value := range []string{s.Start, s.End} {
+		if value == "" {
+			continue
+		}
+		if _, err := SolrTime(value); err != nil {
+			return err
+		}
+	}
+	if len(s.BBox) != 0 && len(s.BBox) != 4 {
+		return errors.New("bbox must hold 4 values: west, south, east, north")
+	}
+	if len(s.BBox) == 4 && s.BBox[1] > s.BBox[3] {
+		return errors.New("bbox south must not be greater than north")
+	}
+	return nil
+}
+
+// rangeMatches returns the range queries for files overlapping the start, end and bbox options
+func (s *Search) rangeMatches() []string {
+	var matches []string
+	if start, err := SolrTime(s.Start); s.Start != "" && err == nil {
+		matches = append(matches, fmt.Sprintf("datetime_stop:[%s TO *]", start))
+	}
+	if end, err := SolrEndTime(s.End); s.End != "" && err == nil {
+		matches = append(matches, fmt.Sprintf("datetime_start:[* TO %s]", end))
+	}
+	if len(s.BBox) == 4 {
+		west, south, east, north := s.BBox[0], s.BBox[1], s.BBox[2], s.BBox[3]
+		if west <= east {
+			matches = append(matches,
+				fmt.Sprintf("east_degrees:[%g TO *]", west),
+				fmt.Sprintf("west_degrees:[* TO %g]", east),
+			)
+		} else {
+			// A box crossing the antimeridian is two boxes, west to 180 and -180 to east
+			matches = append(matches, fmt.Sprintf("(east_degrees:[%g TO *] OR west_degrees:[* TO %g])", west, east))
+		}
+		matches = append(matches,
+			fmt.Sprintf("north_degrees:[%g TO *]", south),
+			fmt.Sprintf("south_degrees:[* TO %g]", north),
+		)
+	}
+	return matches
+}
@@ -0,0 +1,143 @@
+package sproket
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit paces the requests made to each search API host, and holds every request to a host back while
+// it has asked clients to slow down. It is shared by all the searches of a client
+type RateLimit struct {
+	PerSecond float64
+	mutex     sync.Mutex
+	hosts     map[string]*hostPace
+}
+
+// hostPace holds when the next request to a host may be made, and until when the host asked for no requests
+type hostPace struct {
+	next  time.Time
+	until time.Time
+}
+
+// NewRateLimit returns a limit of perSecond requests per second to each host, 0 for no limit beyond the
+// delays asked for by hosts
+func NewRateLimit(perSecond float64) *RateLimit {
+	return &RateLimit{PerSecond: perSecond, hosts: make(map[string]*hostPace)}
+}
+
+// pace returns the pacing of the host, the mutex must be held
+func (r *RateLimit) pace(host string) *hostPace {
+	if r.hosts == nil {
+		r.hosts = make(map[string]*hostPace)
+	}
+	p, ok := r.hosts[host]
+	if !(ok) {
+		p = &hostPace{}
+		r.hosts[host] = p
+	}
+	return p
+}
+
+// wait takes the next turn to request from host, waiting for it unless ctx is done first
+func (r *RateLimit) wait(ctx context.Context, host string) error {
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	p := r.pace(host)
+	at := time.Now()
+	if p.next.After(at) {
+		at = p.next
+	}
+	if p.until.After(at) {
+		at = p.until
+	}
+	if r.PerSecond > 0 {
+		p.next = at.Add(time.Duration(float64(time.Second) / r.PerSecond))
+	}
+	r.mutex.Unlock()
+
+	delay := time.Until(at)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// backOff holds back every request to host for delay
+func (r *RateLimit) backOff(host string, delay time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	p := r.pace(host)
+	if until := time.Now().Add(delay); until.After(p.until) {
+		p.until = until
+	}
+}
+
+// StatusError reports a response other than the one expected, along with the delay asked for by its
+// Retry-After header, if any
+type StatusError struct {
+	Code       int
+	Status     string
+	RetryAfter time.Duration
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return e.Status
+}
+
+// busy reports whether the server turned the request away for being overloaded, rather than failing it
+func (e *StatusError) busy() bool {
+	return e.Code == http.StatusTooManyRequests || e.Code == http.StatusServiceUnavailable
+}
+
+// newStatusError returns the error for an unexpected response,
+// along with the start of its body, which explains requests the server rejected
+func newStatusError(resp *http.Response) *StatusError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return &StatusError{
+		Code:       resp.StatusCode,
+		Status:     resp.Status,
+		RetryAfter: retryAfter(resp.Header.Get("Retry-After")),
+		Message:    string(body),
+	}
+}
+
+// retryAfter parses a Retry-After header, given as seconds or an HTTP date, returning 0 if there is none
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && time.Until(at) > 0 {
+		return time.Until(at)
+	}
+	return 0
+}
+
+// hostOf returns the host requests to target are paced by
+func hostOf(target string) string {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+	return parsed.Host
+}
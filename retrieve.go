@@ -1,40 +1,70 @@
 package sproket
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 )
 
+// newRequest builds a request for inURL with the User-Agent header set
+func (c *Client) newRequest(ctx context.Context, method string, inURL string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, inURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", c.Agent)
+	return req, nil
+}
+
 // Get sets the User-Agent header, performs the GET and writes to the specified dest io writer
-func (s *Search) Get(inURL string, dest io.Writer) error {
+func (c *Client) Get(inURL string, dest io.Writer) error {
+	return c.GetContext(context.Background(), inURL, dest)
+}
+
+// GetContext is Get, abandoning the request once ctx is done
+func (c *Client) GetContext(ctx context.Context, inURL string, dest io.Writer) error {
+	_, err := c.GetFromContext(ctx, inURL, 0, dest)
+	return err
+}
+
+// GetFromContext is GetContext for the bytes of inURL from offset on, used to resume a download.
+// It returns false without writing anything when the server ignores the range and sends the whole file,
+// in which case the download has to start over
+func (c *Client) GetFromContext(ctx context.Context, inURL string, offset int64, dest io.Writer) (bool, error) {
 
 	// Setup http client and set the User-Agent header
-	req, err := http.NewRequest("GET", inURL, nil)
+	req, err := c.newRequest(ctx, "GET", inURL)
 	if err != nil {
-		return err
+		return false, err
+	}
+	expected := http.StatusOK
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		expected = http.StatusPartialContent
 	}
-	req.Header.Set("User-Agent", s.Agent)
 
 	// Perform the HTTP request
-	resp, err := s.HTTPClient.Do(req)
+	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return errors.New(resp.Status)
+	if offset > 0 && resp.StatusCode == http.StatusOK {
+		return false, nil
+	}
+	if resp.StatusCode != expected {
+		return false, newStatusError(resp)
 	}
 
 	// Write to destination
 	nBytes, err := io.Copy(dest, resp.Body)
 	if err != nil {
-		return err
+		return true, err
 	}
 	if resp.ContentLength != -1 && nBytes != resp.ContentLength {
-		return fmt.Errorf("response size mismatch: %d != %d", nBytes, resp.ContentLength)
+		return true, fmt.Errorf("response size mismatch: %d != %d", nBytes, resp.ContentLength)
 	}
-	return nil
+	return true, nil
 }
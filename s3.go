@@ -0,0 +1,342 @@
+package sproket
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3PartSize is the smallest part uploaded to an object store, parts grow for files too large for 10000 of them
+const S3PartSize = 16 * 1024 * 1024
+
+// s3MaxParts is the largest number of parts a multipart upload may have
+const s3MaxParts = 10000
+
+// S3 uploads to an S3 compatible object store, signing requests with AWS signature version 4
+type S3 struct {
+	Endpoint     string
+	Region       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Client       *Client
+}
+
+// NewS3FromEnv configures an object store from the usual AWS environment variables, AWS_ENDPOINT_URL
+// points it at an S3 compatible store other than AWS
+func NewS3FromEnv(client *Client) (*S3, error) {
+	s := S3{
+		Endpoint:     os.Getenv("AWS_ENDPOINT_URL_S3"),
+		Region:       os.Getenv("AWS_REGION"),
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		Client:       client,
+	}
+	if s.Endpoint == "" {
+		s.Endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if s.Region == "" {
+		s.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.Region == "" {
+		s.Region = "us-east-1"
+	}
+	if s.Endpoint == "" {
+		s.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.Region)
+	}
+	s.Endpoint = strings.TrimSuffix(s.Endpoint, "/")
+	if s.AccessKey == "" || s.SecretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required to write to an object store")
+	}
+	return &s, nil
+}
+
+// ParseS3URL splits an s3://bucket/prefix URL into its bucket and key prefix
+func ParseS3URL(s3URL string) (string, string, error) {
+	if !(strings.HasPrefix(s3URL, "s3://")) {
+		return "", "", fmt.Errorf("%s is not an s3:// URL", s3URL)
+	}
+	path := strings.TrimPrefix(s3URL, "s3://")
+	bucket, prefix, _ := strings.Cut(path, "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("%s does not name a bucket", s3URL)
+	}
+	return bucket, strings.Trim(prefix, "/"), nil
+}
+
+// Metadata returns the user metadata of the object, and false if there is no such object
+func (s *S3) Metadata(bucket string, key string) (map[string]string, bool, error) {
+	resp, err := s.do("HEAD", bucket, key, nil, nil, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, false, errors.New(resp.Status)
+	}
+	metadata := make(map[string]string)
+	for name := range resp.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-meta-") {
+			metadata[strings.TrimPrefix(lower, "x-amz-meta-")] = resp.Header.Get(name)
+		}
+	}
+	return metadata, true, nil
+}
+
+// S3Upload streams an object to the store as a multipart upload, nothing is visible until Complete
+type S3Upload struct {
+	s        *S3
+	bucket   string
+	key      string
+	id       string
+	partSize int
+	buffer   bytes.Buffer
+	etags    []string
+	err      error
+}
+
+// NewUpload starts a multipart upload of an object expected to be about size bytes, with user metadata
+func (s *S3) NewUpload(bucket string, key string, size int64, metadata map[string]string) (*S3Upload, error) {
+	headers := make(map[string]string)
+	for name, value := range metadata {
+		headers[fmt.Sprintf("x-amz-meta-%s", strings.ToLower(name))] = value
+	}
+	resp, err := s.do("POST", bucket, key, url.Values{"uploads": {""}}, headers, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error(resp)
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("unable to start upload of %s: %s", key, err)
+	}
+
+	partSize := S3PartSize
+	for size/int64(partSize) >= s3MaxParts {
+		partSize *= 2
+	}
+	return &S3Upload{s: s, bucket: bucket, key: key, id: result.UploadID, partSize: partSize}, nil
+}
+
+// Write buffers p, uploading a part whenever a full part is buffered
+func (u *S3Upload) Write(p []byte) (int, error) {
+	if u.err != nil {
+		return 0, u.err
+	}
+	u.buffer.Write(p)
+	for u.buffer.Len() >= u.partSize {
+		// p is already buffered, so it counts as written even when the part fails
+		if u.err = u.uploadPart(u.buffer.Next(u.partSize)); u.err != nil {
+			return len(p), u.err
+		}
+	}
+	return len(p), nil
+}
+
+// uploadPart uploads the next part, its MD5 lets the store reject a part corrupted in transit
+func (u *S3Upload) uploadPart(part []byte) error {
+	sum := md5.Sum(part)
+	query := url.Values{
+		"partNumber": {fmt.Sprintf("%d", len(u.etags)+1)},
+		"uploadId":   {u.id},
+	}
+	headers := map[string]string{"content-md5": base64.StdEncoding.EncodeToString(sum[:])}
+	var etag string
+	err := u.s.Client.retry(context.Background(), u.s.Endpoint, func() error {
+		resp, err := u.s.do("PUT", u.bucket, u.key, query, headers, part)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return s3Error(resp)
+		}
+		etag = resp.Header.Get("ETag")
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	u.etags = append(u.etags, etag)
+	return nil
+}
+
+// Complete uploads the rest of the buffer and assembles the object from its parts
+func (u *S3Upload) Complete() error {
+	if u.err != nil {
+		return u.err
+	}
+	if u.buffer.Len() != 0 || len(u.etags) == 0 {
+		if err := u.uploadPart(u.buffer.Bytes()); err != nil {
+			return err
+		}
+		u.buffer.Reset()
+	}
+
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	var complete struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}
+	for i, etag := range u.etags {
+		complete.Parts = append(complete.Parts, part{i + 1, etag})
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	return u.s.Client.retry(context.Background(), u.s.Endpoint, func() error {
+		resp, err := u.s.do("POST", u.bucket, u.key, url.Values{"uploadId": {u.id}}, nil, body)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		// Failures to assemble may still be reported with a 200 status, in the body
+		respBody, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || bytes.Contains(respBody, []byte("<Error>")) {
+			return fmt.Errorf("unable to complete upload of %s: %s %s", u.key, resp.Status, respBody)
+		}
+		return nil
+	})
+}
+
+// Abort discards the upload and any parts already uploaded
+func (u *S3Upload) Abort() error {
+	resp, err := u.s.do("DELETE", u.bucket, u.key, url.Values{"uploadId": {u.id}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do performs a signed request against the object, using a path style URL so any S3 compatible store works
+func (s *S3) do(method string, bucket string, key string, query url.Values, headers map[string]string, body []byte) (*http.Response, error) {
+	path := fmt.Sprintf("/%s/%s", s3Escape(bucket), s3Escape(key))
+	reqURL := s.Endpoint + path
+	canonicalQuery := s3Query(query)
+	if canonicalQuery != "" {
+		reqURL = fmt.Sprintf("%s?%s", reqURL, canonicalQuery)
+	}
+	req, err := s.Client.newRequest(context.Background(), method, reqURL)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+
+	// Sign the request
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadSum := sha256.Sum256(body)
+	signed := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": hex.EncodeToString(payloadSum[:]),
+		"x-amz-date":           amzDate,
+	}
+	if s.SessionToken != "" {
+		signed["x-amz-security-token"] = s.SessionToken
+	}
+	for name, value := range headers {
+		signed[name] = value
+	}
+	var names []string
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(signed[name]))
+		if name != "host" {
+			req.Header.Set(name, signed[name])
+		}
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{method, path, canonicalQuery, canonicalHeaders.String(), signedHeaders, signed["x-amz-content-sha256"]}, "\n")
+	requestSum := sha256.Sum256([]byte(canonicalRequest))
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.Region)
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(requestSum[:])}, "\n")
+	signingKey := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{date, s.Region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.AccessKey, scope, signedHeaders, signature))
+
+	return s.Client.HTTPClient.Do(req)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape escapes an object key for a request path, leaving the slashes between its parts
+func s3Escape(key string) string {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		parts[i] = strings.ReplaceAll(url.QueryEscape(part), "+", "%20")
+	}
+	return strings.Join(parts, "/")
+}
+
+// s3Query encodes query parameters sorted by name, as signing requires
+func s3Query(query url.Values) string {
+	var names []string
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", s3Escape(name), s3Escape(value)))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3Error reads the error message of a failed request
+func s3Error(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var result struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if xml.Unmarshal(body, &result) == nil && result.Code != "" {
+		return fmt.Errorf("%s: %s: %s", resp.Status, result.Code, result.Message)
+	}
+	return errors.New(resp.Status)
+}
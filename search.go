@@ -1,16 +1,17 @@
 package sproket
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net/url"
 	"strings"
 )
 
 // SearchRes stores the "response" portion of a Solr query result
 type SearchRes struct {
-	Res Response `json:"response"`
+	Res        Response `json:"response"`
+	NextCursor string   `json:"nextCursorMark"`
 }
 
 // Response stores the number of returned documents and a subset of documents themselves
@@ -26,7 +27,50 @@ type Doc struct {
 	DataNode   string   `json:"data_node"`
 	Sum        []string `json:"checksum"`
 	SumType    []string `json:"checksum_type"`
+	Replica    bool     `json:"replica"`
+	Title      string   `json:"title"`
+	Size       int64    `json:"size"`
+	DatasetID  string   `json:"dataset_id"`
+	PID        []string `json:"pid"`
+	Citation   []string `json:"citation_url"`
 	HTTPURL    string
+	Facets     map[string]string `json:"facets,omitempty"`
+}
+
+// docFields are the keys of a document decoded into its own fields, any others requested are kept as facets
+var docFields = map[string]bool{
+	"url": true, "instance_id": true, "data_node": true, "checksum": true, "checksum_type": true, "replica": true,
+	"title": true, "size": true, "dataset_id": true, "pid": true, "citation_url": true, "HTTPURL": true, "facets": true,
+	"id": true, "score": true, "_version_": true,
+}
+
+// UnmarshalJSON decodes a document, keeping the values of the fields in Search.FileFacets as its facets
+func (d *Doc) UnmarshalJSON(data []byte) error {
+	type plainDoc Doc
+	if err := json.Unmarshal(data, (*plainDoc)(d)); err != nil {
+		return err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for key, value := range raw {
+		if docFields[key] {
+			continue
+		}
+		// Facets are usually multivalued, their values are joined
+		var values []string
+		if json.Unmarshal(value, &values) != nil {
+			var single interface{}
+			json.Unmarshal(value, &single)
+			values = []string{fmt.Sprint(single)}
+		}
+		if d.Facets == nil {
+			d.Facets = make(map[string]string)
+		}
+		d.Facets[key] = strings.Join(values, ",")
+	}
+	return nil
 }
 
 // GetSum returns the checksum, since the checksum is stored as a multivalued field
@@ -45,70 +89,176 @@ func (d *Doc) GetSumType() string {
 	return d.SumType[0]
 }
 
+// GetDatasetInstanceID returns the instance_id of the dataset the file belongs to, which is its dataset_id without the data node
+func (d *Doc) GetDatasetInstanceID() string {
+	return strings.Split(d.DatasetID, "|")[0]
+}
+
+// GetDatasetVersion returns the version of the dataset the file belongs to, taken from the end of its dataset_id
+func (d *Doc) GetDatasetVersion() string {
+	instanceID := d.GetDatasetInstanceID()
+	version := instanceID[strings.LastIndex(instanceID, ".")+1:]
+	if !(strings.HasPrefix(version, "v")) {
+		return ""
+	}
+	return version
+}
+
 // SearchURLs returns a slice of up to "limit" download URLs
 func (s *Search) SearchURLs(skip int, limit int) ([]Doc, int) {
-	q := s.buildQ()
-	params := map[string]string{
-		"query":  q,
+	params := s.fileParams(limit)
+	params["offset"] = fmt.Sprintf("%d", skip)
+
+	result, err := s.searchFiles(params)
+	if err != nil {
+		fmt.Println(err)
+		return nil, 0
+	}
+
+	remaining := result.Res.N - (len(result.Res.Docs) + skip)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return result.Res.Docs, remaining
+}
+
+// fileParams returns the parameters of a search for up to "limit" files
+func (s *Search) fileParams(limit int) map[string]string {
+	fields := []string{"instance_id", "url", "checksum", "data_node", "checksum_type", "replica", "title", "size", "dataset_id", "pid", "citation_url"}
+	return map[string]string{
+		"query":  s.buildQ(),
 		"type":   "File",
 		"format": "application/solr+json",
-		"fields": "instance_id,url,checksum,data_node,checksum_type",
+		"fields": strings.Join(append(fields, s.FileFacets...), ","),
 		"limit":  fmt.Sprintf("%d", limit),
-		"offset": fmt.Sprintf("%d", skip),
 	}
+}
 
-	body, err := s.performSearch(params)
-	if err != nil {
-		fmt.Println(err)
-		return nil, 0
+// searchFiles performs a file search and picks out the HTTP URL of each file
+func (s *Search) searchFiles(params map[string]string) (SearchRes, error) {
+
+	// Parse response body as JSON, merging the responses of every index when federating
+	var result SearchRes
+	if s.Federate {
+		bodies, err := s.performFederated(context.Background(), s.withDistrib(params))
+		if err != nil {
+			return result, err
+		}
+		result = mergeSearchResults(bodies)
+	} else {
+		body, err := s.performSearch(params)
+		if err != nil {
+			return result, err
+		}
+		json.Unmarshal(body, &result)
 	}
 
-	// Parse response body as JSON
+	result.setHTTPURLs()
+	return result, nil
+}
+
+// parseFiles parses the response of a file search and picks out the HTTP URL of each file
+func parseFiles(body []byte) SearchRes {
 	var result SearchRes
 	json.Unmarshal(body, &result)
+	result.setHTTPURLs()
+	return result
+}
 
-	// Get downloadable urls
-	var docs []Doc
-	for _, doc := range result.Res.Docs {
-		for _, url := range doc.URLs {
-			if strings.Contains(url, "HTTPServer") {
-				doc.HTTPURL = strings.Split(url, "|")[0]
+// setHTTPURLs picks out the HTTP URL of each file
+func (r *SearchRes) setHTTPURLs() {
+	for i, doc := range r.Res.Docs {
+		for _, access := range doc.Access() {
+			if access.Service == ServiceHTTP {
+				r.Res.Docs[i].HTTPURL = access.URL
 			}
 		}
-		docs = append(docs, doc)
 	}
+}
 
-	remaining := result.Res.N - (len(result.Res.Docs) + skip)
-	if remaining < 0 {
-		remaining = 0
+// withDistrib adds the distrib parameter to params, if configured
+func (s *Search) withDistrib(params map[string]string) map[string]string {
+	if s.Distrib != nil {
+		params["distrib"] = fmt.Sprintf("%t", *s.Distrib)
 	}
-	return docs, remaining
+	return params
 }
 
 func (s *Search) performSearch(params map[string]string) ([]byte, error) {
+	return s.performSearchContext(context.Background(), params)
+}
+
+// performSearchContext performs the search, failing over to the next search API if one fails
+func (s *Search) performSearchContext(ctx context.Context, params map[string]string) ([]byte, error) {
+	body, _, err := s.performSearchFrom(ctx, params)
+	return body, err
+}
+
+// performSearchFrom is performSearchContext, also returning the search API that answered
+func (s *Search) performSearchFrom(ctx context.Context, params map[string]string) ([]byte, string, error) {
+	if len(s.API) == 0 {
+		return nil, "", errors.New("no search API configured")
+	}
+	params = s.withDistrib(params)
+	var errs searchErrors
+	for _, endpoint := range s.API {
+		body, err := s.performEndpoint(ctx, endpoint, params)
+		if err == nil {
+			return body, endpoint, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", endpoint, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, "", errs
+}
 
-	// Build the search path
-	values := url.Values{}
-	for key, value := range params {
-		values.Add(key, value)
+// searchErrors holds the error of each search API tried, in order
+type searchErrors []error
+
+func (e searchErrors) Error() string {
+	var messages []string
+	for _, err := range e {
+		messages = append(messages, err.Error())
 	}
-	query := values.Encode()
-	path := fmt.Sprintf("%s?%s", s.API, query)
+	return strings.Join(messages, "; ")
+}
 
-	// Perform query
-	buff := bytes.Buffer{}
-	err := s.Get(path, &buff)
-	return buff.Bytes(), err
+func (e searchErrors) Unwrap() []error {
+	return e
 }
 
-func (s *Search) buildQ() string {
-	if len(s.Fields) == 0 {
-		return "*:*"
+// performEndpoint performs the search against a single search API, using the backend that API speaks.
+// Counts and facets are answered from the cache when they have been searched for already
+func (s *Search) performEndpoint(ctx context.Context, endpoint string, params map[string]string) ([]byte, error) {
+	if !(cacheable(params)) {
+		return s.backend(ctx, endpoint).Search(ctx, s, endpoint, params)
 	}
+	cache := s.client().Cache
+	key := cacheKey(endpoint, params)
+	if body, in := cache.get(key); in {
+		return body, nil
+	}
+	body, err := s.backend(ctx, endpoint).Search(ctx, s, endpoint, params)
+	if err == nil {
+		cache.put(key, body)
+	}
+	return body, err
+}
+
+func (s *Search) buildQ() string {
 	var matches []string
+	if s.Query != "" {
+		matches = append(matches, fmt.Sprintf("(%s)", s.Query))
+	}
+	matches = append(matches, s.rangeMatches()...)
 	for key, value := range s.Fields {
 		match := fmt.Sprintf("%s:(%s)", key, value)
 		matches = append(matches, match)
 	}
+	if len(matches) == 0 {
+		return "*:*"
+	}
 	return strings.Join(matches, " AND ")
 }
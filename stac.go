@@ -0,0 +1,821 @@
+package sproket
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// stacPageSize is the number of items, datasets, requested per page of a STAC search
+const stacPageSize = 100
+
+// stacFileFields are properties of the files, the assets of an item, rather than of the item. Criteria on
+// them are applied to the assets once the items are returned
+var stacFileFields = map[string]bool{
+	"instance_id": true, "data_node": true, "size": true, "checksum": true, "checksum_type": true, "title": true,
+	"url": true,
+}
+
+// stacPlainFields are item properties named without the collection's prefix
+var stacPlainFields = map[string]bool{"id": true, "latest": true, "retracted": true, "version": true}
+
+// datasetVersion matches the dataset instance_id at the start of a file instance_id, which ends with the version
+var datasetVersion = regexp.MustCompile(`^(.*\.v[0-9]+)\.`)
+
+// STACBackend searches a STAC API, such as the ESGF 1.5 search API. Each item is a dataset and each of its
+// data assets a file, which are mapped to the documents of the classic search API so existing configs keep
+// working. Facet counts come from the aggregation extension, and are counts of datasets, or else from reading
+// every matching file
+type STACBackend struct{}
+
+// stacItem is a single item of a STAC search, one dataset
+type stacItem struct {
+	ID         string                 `json:"id"`
+	Properties map[string]interface{} `json:"properties"`
+	Assets     map[string]stacAsset   `json:"assets"`
+}
+
+// stacAsset is a single asset of an item, one file or other resource of the dataset
+type stacAsset struct {
+	Href     string   `json:"href"`
+	Type     string   `json:"type"`
+	Title    string   `json:"title"`
+	Roles    []string `json:"roles"`
+	Size     int64    `json:"file:size"`
+	Checksum string   `json:"file:checksum"`
+}
+
+// stacLink is a link of a STAC response, the next link continues a search
+type stacLink struct {
+	Rel    string                 `json:"rel"`
+	Href   string                 `json:"href"`
+	Method string                 `json:"method"`
+	Body   map[string]interface{} `json:"body"`
+	Merge  bool                   `json:"merge"`
+}
+
+// stacPage is a page of a STAC search
+type stacPage struct {
+	Features      []stacItem `json:"features"`
+	Links         []stacLink `json:"links"`
+	NumberMatched *int       `json:"numberMatched"`
+	Context       struct {
+		Matched *int `json:"matched"`
+	} `json:"context"`
+}
+
+// stacQuery is a search translated to STAC, the body of its requests and the criteria applied to files
+type stacQuery struct {
+	body   map[string]interface{}
+	files  map[string]string
+	fields []string
+	none   bool
+}
+
+// Search translates the search to the STAC API and its response back to a Solr response
+func (b STACBackend) Search(ctx context.Context, s *Search, endpoint string, params map[string]string) ([]byte, error) {
+	q := newSTACQuery(s, params)
+	limit, _ := strconv.Atoi(params["limit"])
+	offset, _ := strconv.Atoi(params["offset"])
+
+	if params["facet.pivot"] != "" {
+		return nil, errors.New("facet pivots are not supported by STAC search APIs")
+	}
+	if params["facets"] != "" && limit == 0 {
+		return b.facets(ctx, s, endpoint, q, strings.Split(params["facets"], ","))
+	}
+	if params["type"] == "Dataset" {
+		return b.datasets(ctx, s, endpoint, q, offset, limit)
+	}
+	if cursor, in := params["cursorMark"]; in {
+		return b.filePage(ctx, s, endpoint, q, cursor)
+	}
+	return b.files(ctx, s, endpoint, q, offset, limit)
+}
+
+// stacRoot returns the landing page of the STAC API serving endpoint
+func stacRoot(endpoint string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(endpoint, "/"), "/search")
+}
+
+// newSTACQuery translates the criteria of the search, the fields, free text query and time and space ranges
+func newSTACQuery(s *Search, params map[string]string) stacQuery {
+	collection := s.STACCollection
+	if collection == "" {
+		collection = s.Fields["project"]
+	}
+	if collection == "" || strings.ContainsAny(collection, " *") {
+		collection = "CMIP6"
+	}
+	prefix := s.STACPrefix
+	if prefix == "" {
+		prefix = strings.ToLower(collection) + ":"
+	}
+
+	q := stacQuery{
+		body:  map[string]interface{}{"collections": []string{collection}},
+		files: make(map[string]string),
+	}
+	var filters []interface{}
+	for key, value := range s.Fields {
+		field := strings.TrimPrefix(key, "-")
+		switch {
+		case field == "project" && strings.EqualFold(value, collection):
+		case field == "replica":
+			// Items are the original datasets
+			if value == "true" {
+				q.none = true
+			}
+		case field == "dataset_id":
+			// dataset_id is the dataset instance_id followed by |data_node, the item id is the instance_id alone
+			var ids []string
+			for _, term := range splitTerms(value) {
+				ids = append(ids, strings.Split(term, "|")[0])
+			}
+			if filter := termFilter("id", ids); filter != nil {
+				filters = append(filters, negated(key, filter))
+			}
+		case field == "instance_id" && !(strings.HasPrefix(key, "-")):
+			// Only the items holding the files need to be searched
+			var ids []string
+			for _, term := range splitTerms(value) {
+				if match := datasetVersion.FindStringSubmatch(term); match != nil && !(strings.ContainsAny(term, "*?")) {
+					ids = append(ids, match[1])
+				}
+			}
+			if filter := termFilter("id", ids); filter != nil && len(ids) == len(splitTerms(value)) {
+				filters = append(filters, filter)
+			}
+			q.files[key] = value
+		case stacFileFields[field]:
+			q.files[key] = value
+		default:
+			property := prefix + field
+			if stacPlainFields[field] {
+				property = field
+			}
+			if filter := termFilter(property, splitTerms(value)); filter != nil {
+				filters = append(filters, negated(key, filter))
+			}
+		}
+	}
+	if len(filters) != 0 {
+		q.body["filter-lang"] = "cql2-json"
+		q.body["filter"] = map[string]interface{}{"op": "and", "args": filters}
+	}
+	if s.Query != "" {
+		q.body["q"] = []string{s.Query}
+	}
+	if s.Start != "" || s.End != "" {
+		start, end := "..", ".."
+		if t, err := SolrTime(s.Start); s.Start != "" && err == nil {
+			start = t
+		}
+		if t, err := SolrEndTime(s.End); s.End != "" && err == nil {
+			end = t
+		}
+		q.body["datetime"] = fmt.Sprintf("%s/%s", start, end)
+	}
+	if len(s.BBox) == 4 {
+		q.body["bbox"] = s.BBox
+	}
+
+	// Item properties requested are passed on with each file
+	if fields := params["fields"]; fields == "*" {
+		q.fields = []string{"*"}
+	} else if fields != "" {
+		q.fields = strings.Split(fields, ",")
+	}
+	return q
+}
+
+// splitTerms splits a field value into the terms it matches any of, removing the escaping of special characters
+func splitTerms(value string) []string {
+	var terms []string
+	for _, term := range strings.Split(value, " OR ") {
+		term = strings.TrimSpace(term)
+		term = strings.TrimSuffix(strings.TrimPrefix(term, "("), ")")
+		var unescaped strings.Builder
+		escaped := false
+		for _, r := range term {
+			if r == '\\' && !(escaped) {
+				escaped = true
+				continue
+			}
+			escaped = false
+			unescaped.WriteRune(r)
+		}
+		terms = append(terms, unescaped.String())
+	}
+	return terms
+}
+
+// termFilter returns the CQL2 filter matching a property against any of the terms, which may be wildcards or
+// ranges. A term of * matches anything, so needs no filter
+func termFilter(property string, terms []string) interface{} {
+	var matches []interface{}
+	for _, term := range terms {
+		if term == "*" {
+			return nil
+		}
+		prop := map[string]string{"property": property}
+		if from, to, isRange := parseRange(term); isRange {
+			var bounds []interface{}
+			if from != "*" {
+				bounds = append(bounds, map[string]interface{}{"op": ">=", "args": []interface{}{prop, typedTerm(from)}})
+			}
+			if to != "*" {
+				bounds = append(bounds, map[string]interface{}{"op": "<=", "args": []interface{}{prop, typedTerm(to)}})
+			}
+			if len(bounds) == 0 {
+				return nil
+			}
+			matches = append(matches, map[string]interface{}{"op": "and", "args": bounds})
+		} else if strings.ContainsAny(term, "*?") {
+			pattern := strings.NewReplacer("*", "%", "?", "_").Replace(term)
+			matches = append(matches, map[string]interface{}{"op": "like", "args": []interface{}{prop, pattern}})
+		} else {
+			var match interface{} = term
+			if term == "true" || term == "false" {
+				match = (term == "true")
+			}
+			matches = append(matches, map[string]interface{}{"op": "=", "args": []interface{}{prop, match}})
+		}
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+	if len(matches) == 1 {
+		return matches[0]
+	}
+	return map[string]interface{}{"op": "or", "args": matches}
+}
+
+// negated wraps the filter of a negated field, one whose key starts with -
+func negated(key string, filter interface{}) interface{} {
+	if filter == nil || !(strings.HasPrefix(key, "-")) {
+		return filter
+	}
+	return map[string]interface{}{"op": "not", "args": []interface{}{filter}}
+}
+
+// parseRange splits a range term like [10 TO *] into its bounds
+func parseRange(term string) (string, string, bool) {
+	if !(strings.HasPrefix(term, "[")) || !(strings.HasSuffix(term, "]")) {
+		return "", "", false
+	}
+	from, to, found := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(term, "["), "]"), " TO ")
+	return strings.TrimSpace(from), strings.TrimSpace(to), found
+}
+
+// typedTerm converts a range bound to a number, if it is one
+func typedTerm(term string) interface{} {
+	if number, err := strconv.ParseFloat(term, 64); err == nil {
+		return number
+	}
+	return term
+}
+
+// matchesFile reports whether a file document meets the criteria on files
+func (q stacQuery) matchesFile(doc map[string]interface{}) bool {
+	for key, value := range q.files {
+		field := strings.TrimPrefix(key, "-")
+		actual := fmt.Sprint(doc[field])
+		if list, ok := doc[field].([]string); ok && len(list) != 0 {
+			actual = list[0]
+		}
+		matched := false
+		for _, term := range splitTerms(value) {
+			if from, to, isRange := parseRange(term); isRange {
+				number, _ := strconv.ParseFloat(actual, 64)
+				low, lowErr := strconv.ParseFloat(from, 64)
+				high, highErr := strconv.ParseFloat(to, 64)
+				matched = (from == "*" || (lowErr == nil && number >= low)) && (to == "*" || (highErr == nil && number <= high))
+			} else if ok, _ := path.Match(term, actual); ok {
+				matched = true
+			}
+			if matched {
+				break
+			}
+		}
+		if matched == strings.HasPrefix(key, "-") {
+			return false
+		}
+	}
+	return true
+}
+
+// fileResults returns the file documents of an item as results of a walk over the items
+func (q stacQuery) fileResults(item stacItem) []interface{} {
+	var docs []interface{}
+	for _, doc := range q.fileDocs(item) {
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+// fileDocs maps the data assets of an item to file documents of the classic search API
+func (q stacQuery) fileDocs(item stacItem) []map[string]interface{} {
+	var names []string
+	for name := range item.Assets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var docs []map[string]interface{}
+	for _, name := range names {
+		asset := item.Assets[name]
+		if !(isDataAsset(asset)) {
+			continue
+		}
+		u, err := url.Parse(asset.Href)
+		if err != nil {
+			continue
+		}
+		filename := path.Base(u.Path)
+		doc := map[string]interface{}{
+			"instance_id": fmt.Sprintf("%s.%s", item.ID, filename),
+			"title":       filename,
+			"url":         []string{fmt.Sprintf("%s|application/netcdf|HTTPServer", asset.Href)},
+			"data_node":   u.Hostname(),
+			"dataset_id":  fmt.Sprintf("%s|%s", item.ID, u.Hostname()),
+			"size":        asset.Size,
+			"replica":     false,
+		}
+		if sum, sumType := multihash(asset.Checksum); sum != "" {
+			doc["checksum"] = []string{sum}
+			doc["checksum_type"] = []string{sumType}
+		}
+		for _, field := range q.fields {
+			for key, value := range item.Properties {
+				short := key[strings.Index(key, ":")+1:]
+				if _, in := doc[short]; !(in) && (field == "*" || field == short) {
+					doc[short] = value
+				}
+			}
+		}
+		if q.matchesFile(doc) {
+			docs = append(docs, doc)
+		}
+	}
+	return docs
+}
+
+// isDataAsset reports whether an asset is a data file, rather than a thumbnail or metadata
+func isDataAsset(asset stacAsset) bool {
+	for _, role := range asset.Roles {
+		if role == "data" {
+			return true
+		}
+	}
+	return strings.Contains(asset.Type, "netcdf") || strings.HasSuffix(asset.Href, ".nc")
+}
+
+// multihash converts a multihash checksum, as in file:checksum, to a hex checksum and its type
+func multihash(checksum string) (string, string) {
+	switch {
+	case strings.HasPrefix(checksum, "1220") && len(checksum) == 68:
+		return checksum[4:], "SHA256"
+	case strings.HasPrefix(checksum, "d50110") && len(checksum) == 38:
+		return checksum[6:], "MD5"
+	}
+	return "", ""
+}
+
+// request performs a request of a STAC search, continuing from the next link if there is one
+func (b STACBackend) request(ctx context.Context, s *Search, endpoint string, q stacQuery, next *stacLink, limit int) (stacPage, error) {
+	var page stacPage
+	body := make(map[string]interface{})
+	for key, value := range q.body {
+		body[key] = value
+	}
+	body["limit"] = limit
+	target := stacRoot(endpoint) + "/search"
+	method := "POST"
+	if next != nil {
+		target = next.Href
+		method = next.Method
+		if method == "" {
+			method = "GET"
+		}
+		if !(next.Merge) {
+			body = make(map[string]interface{})
+		}
+		for key, value := range next.Body {
+			body[key] = value
+		}
+	}
+
+	buff := bytes.Buffer{}
+	err := s.client().retry(ctx, target, func() error {
+		buff.Reset()
+		if method == "GET" {
+			return s.client().GetContext(ctx, target, &buff)
+		}
+		return s.client().postJSON(ctx, target, body, &buff)
+	})
+	if err != nil {
+		return page, err
+	}
+	if err := json.Unmarshal(buff.Bytes(), &page); err != nil {
+		return page, fmt.Errorf("invalid STAC response from %s: %s", target, err)
+	}
+	return page, nil
+}
+
+// nextLink returns the link continuing the search after page, or nil on the last page
+func (p stacPage) nextLink() *stacLink {
+	for i, link := range p.Links {
+		if link.Rel == "next" {
+			return &p.Links[i]
+		}
+	}
+	return nil
+}
+
+// matched returns the number of items matching the search, or -1 if the API does not report it
+func (p stacPage) matched() int {
+	if p.NumberMatched != nil {
+		return *p.NumberMatched
+	}
+	if p.Context.Matched != nil {
+		return *p.Context.Matched
+	}
+	return -1
+}
+
+// walk calls visit with each page of items matching the query, until visit returns false or none remain
+func (b STACBackend) walk(ctx context.Context, s *Search, endpoint string, q stacQuery, visit func(page stacPage) bool) error {
+	if q.none {
+		return nil
+	}
+	var next *stacLink
+	for {
+		page, err := b.request(ctx, s, endpoint, q, next, stacPageSize)
+		if err != nil {
+			return err
+		}
+		next = page.nextLink()
+		if !(visit(page)) || next == nil || len(page.Features) == 0 {
+			return nil
+		}
+	}
+}
+
+// solrFiles encodes file documents as the response of a file search
+func solrFiles(n int, docs []map[string]interface{}, cursor string) ([]byte, error) {
+	if docs == nil {
+		docs = []map[string]interface{}{}
+	}
+	result := map[string]interface{}{
+		"response": map[string]interface{}{"numFound": n, "docs": docs},
+	}
+	if cursor != "" {
+		result["nextCursorMark"] = cursor
+	}
+	return json.Marshal(result)
+}
+
+// stacWalk is what walking the results of a STAC search has found so far: where each page of items starts
+// and, once known, the total. Later pages start from the nearest page already found rather than the first
+type stacWalk struct {
+	pages []stacPosition
+	total int
+	mutex sync.Mutex
+}
+
+// stacPosition is a page of items, the link to it, nil for the first page, and the index of its first result
+type stacPosition struct {
+	first int
+	link  *stacLink
+}
+
+// stacWalk returns what is known of walking the results of the STAC search named by key. Without a cache
+// nothing is kept, and every walk starts from the first page
+func (c *Cache) stacWalk(key string) *stacWalk {
+	if c == nil {
+		return &stacWalk{total: -1}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.walks == nil {
+		c.walks = make(map[string]*stacWalk)
+	}
+	walk, in := c.walks[key]
+	if !(in) {
+		walk = &stacWalk{total: -1}
+		c.walks[key] = walk
+	}
+	return walk
+}
+
+// from returns the last page found that starts at or before the result at offset
+func (w *stacWalk) from(offset int) stacPosition {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	var position stacPosition
+	for _, page := range w.pages {
+		if page.first > offset {
+			break
+		}
+		position = page
+	}
+	return position
+}
+
+// reached records a page, pages are found in order so only those beyond the last one found are new
+func (w *stacWalk) reached(position stacPosition) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if len(w.pages) == 0 || position.first > w.pages[len(w.pages)-1].first {
+		w.pages = append(w.pages, position)
+	}
+}
+
+// counted returns the total, and whether it is known
+func (w *stacWalk) counted() (int, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.total, w.total >= 0
+}
+
+// count records the total
+func (w *stacWalk) count(total int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.total = total
+}
+
+// results returns up to limit of the results, of the kind each item yields through expand, after skipping
+// offset, along with the total. The walk starts from the nearest page an earlier walk of the search found.
+// The total is the API's count of items when matched says it counts the results, or else is read once by
+// walking every item, after which pages stop reading once full
+func (b STACBackend) results(ctx context.Context, s *Search, endpoint string, q stacQuery, kind string, matched bool,
+	offset int, limit int, expand func(item stacItem) []interface{}) ([]interface{}, int, error) {
+	if q.none {
+		return nil, 0, nil
+	}
+	body, _ := json.Marshal(q.body)
+	files, _ := json.Marshal(q.files)
+	walk := s.client().Cache.stacWalk(fmt.Sprintf("%s %s %s %s", kind, endpoint, body, files))
+	position := walk.from(offset)
+	n, next := position.first, position.link
+	var results []interface{}
+	for {
+		if total, known := walk.counted(); known && (len(results) == limit || n >= total) {
+			return results, total, nil
+		}
+		page, err := b.request(ctx, s, endpoint, q, next, stacPageSize)
+		if err != nil {
+			return nil, 0, err
+		}
+		if matched && page.matched() >= 0 {
+			walk.count(page.matched())
+		}
+		for _, item := range page.Features {
+			for _, result := range expand(item) {
+				if n >= offset && len(results) < limit {
+					results = append(results, result)
+				}
+				n++
+			}
+		}
+		next = page.nextLink()
+		if next == nil || len(page.Features) == 0 {
+			walk.count(n)
+			return results, n, nil
+		}
+		walk.reached(stacPosition{first: n, link: next})
+	}
+}
+
+// files returns up to limit files after skipping offset. The API counts items, which are datasets, so the
+// number of files is only known by reading every item once
+func (b STACBackend) files(ctx context.Context, s *Search, endpoint string, q stacQuery, offset int, limit int) ([]byte, error) {
+	results, n, err := b.results(ctx, s, endpoint, q, "files", false, offset, limit, q.fileResults)
+	if err != nil {
+		return nil, err
+	}
+	var docs []map[string]interface{}
+	for _, result := range results {
+		docs = append(docs, result.(map[string]interface{}))
+	}
+	return solrFiles(n, docs, "")
+}
+
+// filePage returns the files of the next page of items the cursor points to with any files matching, reading
+// on past pages whose files all fail the criteria on files. The cursor encodes the next link of the STAC search,
+// and stays the same once the last page has been read
+func (b STACBackend) filePage(ctx context.Context, s *Search, endpoint string, q stacQuery, cursor string) ([]byte, error) {
+	var next *stacLink
+	if cursor != cursorStart {
+		decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err == nil {
+			next = &stacLink{}
+			err = json.Unmarshal(decoded, next)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor %s: %s", cursor, err)
+		}
+	}
+	if q.none {
+		return solrFiles(0, nil, cursor)
+	}
+	_, total, err := b.results(ctx, s, endpoint, q, "files", false, 0, 0, q.fileResults)
+	if err != nil {
+		return nil, err
+	}
+	var docs []map[string]interface{}
+	for len(docs) == 0 {
+		page, err := b.request(ctx, s, endpoint, q, next, stacPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Features {
+			docs = append(docs, q.fileDocs(item)...)
+		}
+		next = page.nextLink()
+		if next == nil || len(page.Features) == 0 {
+			return solrFiles(total, docs, cursor)
+		}
+	}
+	encoded, err := json.Marshal(next)
+	if err != nil {
+		return nil, err
+	}
+	return solrFiles(total, docs, base64.RawURLEncoding.EncodeToString(encoded))
+}
+
+// datasets returns up to limit datasets after skipping offset, with their file counts and sizes. Without
+// criteria on files every item is a dataset, so the API's count of items is the number of datasets
+func (b STACBackend) datasets(ctx context.Context, s *Search, endpoint string, q stacQuery, offset int, limit int) ([]byte, error) {
+	results, n, err := b.results(ctx, s, endpoint, q, "datasets", len(q.files) == 0, offset, limit, func(item stacItem) []interface{} {
+		docs := q.fileDocs(item)
+		if len(docs) == 0 {
+			return nil
+		}
+		dataset := Dataset{InstanceID: item.ID, DataNode: docs[0]["data_node"].(string), Files: len(docs)}
+		for _, doc := range docs {
+			dataset.Size += doc["size"].(int64)
+		}
+		return []interface{}{dataset}
+	})
+	if err != nil {
+		return nil, err
+	}
+	datasets := []Dataset{}
+	for _, result := range results {
+		datasets = append(datasets, result.(Dataset))
+	}
+	return json.Marshal(map[string]interface{}{
+		"response": map[string]interface{}{"numFound": n, "docs": datasets},
+	})
+}
+
+// facets returns the values of each field with their counts, from the aggregation extension if the API has
+// it, or else by reading every matching file
+func (b STACBackend) facets(ctx context.Context, s *Search, endpoint string, q stacQuery, fields []string) ([]byte, error) {
+	facetFields := make(map[string][]interface{})
+	var unaggregated []string
+	for _, field := range fields {
+		values, err := b.aggregate(ctx, s, endpoint, q, field)
+		if err != nil {
+			unaggregated = append(unaggregated, field)
+			continue
+		}
+		facetFields[field] = values
+	}
+
+	if len(unaggregated) != 0 {
+		counts := make(map[string]map[string]int)
+		for _, field := range unaggregated {
+			counts[field] = make(map[string]int)
+		}
+		facetQuery := q
+		facetQuery.fields = unaggregated
+		err := b.walk(ctx, s, endpoint, facetQuery, func(page stacPage) bool {
+			for _, item := range page.Features {
+				for _, doc := range facetQuery.fileDocs(item) {
+					for _, field := range unaggregated {
+						if value, in := doc[field]; in {
+							counts[field][facetString(value)]++
+						}
+					}
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		for field, valueCounts := range counts {
+			values := []interface{}{}
+			for value, count := range valueCounts {
+				values = append(values, value, float64(count))
+			}
+			facetFields[field] = values
+		}
+	}
+	return json.Marshal(map[string]interface{}{
+		"response":     map[string]interface{}{"numFound": 0, "docs": []interface{}{}},
+		"facet_counts": map[string]interface{}{"facet_fields": facetFields},
+	})
+}
+
+// aggregate counts the datasets with each value of the field using the aggregation extension
+func (b STACBackend) aggregate(ctx context.Context, s *Search, endpoint string, q stacQuery, field string) ([]interface{}, error) {
+	if stacFileFields[field] || q.none {
+		return nil, fmt.Errorf("%s can not be aggregated", field)
+	}
+	property := strings.ToLower(q.body["collections"].([]string)[0]) + ":" + field
+	if s.STACPrefix != "" {
+		property = s.STACPrefix + field
+	}
+	if stacPlainFields[field] {
+		property = field
+	}
+	name := property + "_frequency"
+	body := make(map[string]interface{})
+	for key, value := range q.body {
+		body[key] = value
+	}
+	body["aggregations"] = []string{name}
+
+	buff := bytes.Buffer{}
+	target := stacRoot(endpoint) + "/aggregate"
+	err := s.client().retry(ctx, target, func() error {
+		buff.Reset()
+		return s.client().postJSON(ctx, target, body, &buff)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Aggregations []struct {
+			Name    string `json:"name"`
+			Buckets []struct {
+				Key       interface{} `json:"key"`
+				Frequency int         `json:"frequency"`
+			} `json:"buckets"`
+		} `json:"aggregations"`
+	}
+	if err := json.Unmarshal(buff.Bytes(), &result); err != nil {
+		return nil, err
+	}
+	for _, aggregation := range result.Aggregations {
+		if aggregation.Name != name {
+			continue
+		}
+		values := []interface{}{}
+		for _, bucket := range aggregation.Buckets {
+			values = append(values, facetString(bucket.Key), float64(bucket.Frequency))
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("no %s aggregation", name)
+}
+
+// facetString converts a property value to the string form of a facet value
+func facetString(value interface{}) string {
+	if list, ok := value.([]interface{}); ok && len(list) != 0 {
+		value = list[0]
+	}
+	return fmt.Sprint(value)
+}
+
+// postJSON posts body as JSON to inURL and writes the response to dest
+func (c *Client) postJSON(ctx context.Context, inURL string, body interface{}, dest io.Writer) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := c.newRequest(ctx, "POST", inURL)
+	if err != nil {
+		return err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(encoded))
+	req.ContentLength = int64(len(encoded))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newStatusError(resp)
+	}
+	_, err = io.Copy(dest, resp.Body)
+	return err
+}
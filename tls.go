@@ -0,0 +1,171 @@
+package sproket
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSFiles names the optional certificate files used for TLS connections
+type TLSFiles struct {
+	CABundle   string
+	ClientCert string
+	ClientKey  string
+}
+
+// certReloader holds the certificates loaded from TLSFiles and reloads them once they change on disk
+type certReloader struct {
+	files    TLSFiles
+	interval time.Duration
+	mutex    sync.Mutex
+	checked  time.Time
+	modTimes map[string]time.Time
+	roots    *x509.CertPool
+	cert     *tls.Certificate
+}
+
+// NewTLSConfig builds a TLS config that resumes sessions and uses the provided certificate files, which are
+// checked for changes at most once per interval so renewed credentials are picked up without a restart
+func NewTLSConfig(files TLSFiles, interval time.Duration) (*tls.Config, error) {
+	conf := &tls.Config{
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	if files.CABundle == "" && files.ClientCert == "" {
+		return conf, nil
+	}
+	if (files.ClientCert == "") != (files.ClientKey == "") {
+		return nil, errors.New("client_cert and client_key must be specified together")
+	}
+
+	r := &certReloader{files: files, interval: interval}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	if files.CABundle != "" {
+		// The bundle may change between connections, so verify against the current bundle by hand
+		conf.InsecureSkipVerify = true
+		conf.VerifyConnection = r.verify
+	}
+	if files.ClientCert != "" {
+		conf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			_, cert := r.current()
+			return cert, nil
+		}
+	}
+	return conf, nil
+}
+
+// withHost returns the config for a connection to host. Certificates checked by hand are verified against the
+// host dialed, as an IP address is not sent as the server name
+func withHost(conf *tls.Config, host string) *tls.Config {
+	c := conf.Clone()
+	if c.ServerName == "" {
+		c.ServerName = host
+	}
+	if verify := conf.VerifyConnection; verify != nil {
+		name := c.ServerName
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			cs.ServerName = name
+			return verify(cs)
+		}
+	}
+	return c
+}
+
+// load reads all certificate files and records their modification times
+func (r *certReloader) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, path := range []string{r.files.CABundle, r.files.ClientCert, r.files.ClientKey} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		modTimes[path] = info.ModTime()
+	}
+
+	var roots *x509.CertPool
+	if r.files.CABundle != "" {
+		pemBytes, err := ioutil.ReadFile(r.files.CABundle)
+		if err != nil {
+			return err
+		}
+		roots = x509.NewCertPool()
+		if !(roots.AppendCertsFromPEM(pemBytes)) {
+			return fmt.Errorf("%s contains no certificates", r.files.CABundle)
+		}
+	}
+	var cert *tls.Certificate
+	if r.files.ClientCert != "" {
+		pair, err := tls.LoadX509KeyPair(r.files.ClientCert, r.files.ClientKey)
+		if err != nil {
+			return err
+		}
+		cert = &pair
+	}
+
+	r.mutex.Lock()
+	r.roots = roots
+	r.cert = cert
+	r.modTimes = modTimes
+	r.checked = time.Now()
+	r.mutex.Unlock()
+	return nil
+}
+
+// current returns the loaded certificates, reloading them first if they are due a check and have changed
+func (r *certReloader) current() (*x509.CertPool, *tls.Certificate) {
+	r.mutex.Lock()
+	due := time.Since(r.checked) >= r.interval
+	if due {
+		r.checked = time.Now()
+	}
+	changed := false
+	if due {
+		for path, modTime := range r.modTimes {
+			info, err := os.Stat(path)
+			if err == nil && !(info.ModTime().Equal(modTime)) {
+				changed = true
+			}
+		}
+	}
+	r.mutex.Unlock()
+
+	// A failed reload, a half written renewal for example, keeps the previous certificates
+	if changed {
+		r.load()
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.roots, r.cert
+}
+
+// verify checks the server certificate chain against the current CA bundle
+func (r *certReloader) verify(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server presented no certificates")
+	}
+	// Never skip checking the host, an IP address is only known from the dial
+	if cs.ServerName == "" {
+		return errors.New("no host name to verify the server certificate against")
+	}
+	roots, _ := r.current()
+	opts := x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}